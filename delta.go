@@ -0,0 +1,94 @@
+package siser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// deltaTag is a header tag marking records written as a delta
+// (see Writer.Delta)
+const deltaTag = "siser.delta"
+
+/*
+A delta is a record with changes between 2 records. For each key that
+was added or has a different value there's an entry "=key: value".
+For each removed key there's an entry "-key" with empty value.
+*/
+
+// Diff returns a delta with changes from prev to curr, which ApplyDelta
+// uses to re-create curr from prev. Returns false if curr can't be
+// re-created from a delta (e.g. when it has duplicate keys or keys
+// in a different order than in prev)
+func Diff(prev, curr *Record) (*Record, bool) {
+	if prev.HasDuplicateKeys() || curr.HasDuplicateKeys() {
+		return nil, false
+	}
+	delta := &Record{}
+	for _, e := range prev.Entries {
+		if !curr.Has(e.Key) {
+			delta.appendKeyVal("-"+e.Key, "")
+		}
+	}
+	for _, e := range curr.Entries {
+		v, ok := prev.Get(e.Key)
+		if !ok || v != e.Value {
+			delta.appendKeyVal("="+e.Key, e.Value)
+		}
+	}
+	entries, err := applyDelta(prev.Entries, delta.Entries)
+	if err != nil || !entriesEqual(entries, curr.Entries) {
+		return nil, false
+	}
+	return delta, true
+}
+
+// ApplyDelta returns a record with entries re-created from base
+// and a delta created by Diff
+func ApplyDelta(base, delta *Record) (*Record, error) {
+	entries, err := applyDelta(base.Entries, delta.Entries)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		Entries: entries,
+	}, nil
+}
+
+// applyDelta applies delta to a copy of base. Changed values are
+// updated in place, added values are appended
+func applyDelta(base []Entry, delta []Entry) ([]Entry, error) {
+	res := append([]Entry(nil), base...)
+	for _, e := range delta {
+		if e.Key == "" {
+			return nil, errors.New("empty key in delta")
+		}
+		key := e.Key[1:]
+		switch e.Key[0] {
+		case '=':
+			if idx := indexOfKey(res, key); idx != -1 {
+				res[idx].Value = e.Value
+			} else {
+				res = append(res, Entry{key, e.Value})
+			}
+		case '-':
+			if idx := indexOfKey(res, key); idx != -1 {
+				res = append(res[:idx], res[idx+1:]...)
+			}
+		default:
+			return nil, fmt.Errorf("invalid key '%s' in delta", e.Key)
+		}
+	}
+	return res, nil
+}
+
+func entriesEqual(a, b []Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
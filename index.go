@@ -0,0 +1,310 @@
+package siser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Index maps names of records to their positions in the data
+// (as in Reader.CurrRecordPos)
+type Index struct {
+	offsets map[string][]int64
+}
+
+// BuildIndex reads all records from r and builds an index of their
+// positions by name. Only headers are parsed, data of records is skipped.
+// A record at a given position can be read with ReadRecordAt
+func BuildIndex(r io.Reader) (*Index, error) {
+	reader := NewReader(bufio.NewReader(r))
+	idx := &Index{
+		offsets: map[string][]int64{},
+	}
+	for reader.readNext(true) {
+		name := reader.Name
+		idx.offsets[name] = append(idx.offsets[name], reader.CurrRecordPos)
+	}
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Lookup returns positions of records with a given name, in the order
+// they appear in the data
+func (i *Index) Lookup(name string) []int64 {
+	return i.offsets[name]
+}
+
+// Names returns names of all records in the index
+func (i *Index) Names() []string {
+	var res []string
+	for name := range i.offsets {
+		res = append(res, name)
+	}
+	return res
+}
+
+// SplitBoundaries returns positions of records in r (which has size bytes)
+// that split it into n chunks of approximately equal size, so that
+// they can be processed in parallel e.g. with ReadRecordAt.
+// The first position is always 0. There are fewer than n positions if
+// records are too large to split into n chunks.
+// Only headers of records are read, data is skipped
+func SplitBoundaries(r io.ReaderAt, size int64, n int) ([]int64, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of chunks %d", n)
+	}
+	res := []int64{0}
+	var hdrReader Reader
+	var pos int64
+	i := 1
+	for i < n && pos < size {
+		recLen, err := recordLenAt(r, pos, &hdrReader)
+		if err != nil {
+			return nil, err
+		}
+		pos += recLen
+		if pos >= size {
+			break
+		}
+		if pos < int64(i)*size/int64(n) {
+			continue
+		}
+		res = append(res, pos)
+		// a large record might span more than one chunk
+		for i < n && int64(i)*size/int64(n) <= pos {
+			i++
+		}
+	}
+	return res, nil
+}
+
+// recordLenAt returns the size of a record at pos in r, including header.
+// hdrReader is used to parse the header
+func recordLenAt(r io.ReaderAt, pos int64, hdrReader *Reader) (int64, error) {
+	var hdr []byte
+	var buf [128]byte
+	for {
+		n, err := r.ReadAt(buf[:], pos+int64(len(hdr)))
+		idx := bytes.IndexByte(buf[:n], '\n')
+		if idx != -1 {
+			hdr = append(hdr, buf[:idx+1]...)
+			break
+		}
+		hdr = append(hdr, buf[:n]...)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	size, err := hdrReader.parseHeader(hdr)
+	if err != nil {
+		return 0, err
+	}
+	recLen := int64(len(hdr)) + size
+	if size > 0 {
+		// same as needsNewline logic in Writer.Write, but padding
+		// might be disabled with Writer.NoPadding
+		n, err := r.ReadAt(buf[:2], pos+recLen-1)
+		if n == 0 {
+			if err == io.EOF || err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if n == 2 && buf[0] != '\n' && buf[1] == '\n' {
+			recLen++
+		}
+	}
+	return recLen, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Verify checks that r has valid records, as written by Writer.
+// Only the framing is checked i.e. headers and sizes of data,
+// not the content of data.
+// Returns number of valid records and, if data is not valid,
+// the error and position where invalid data starts. If there are no
+// errors, errOffset is -1
+func Verify(r io.Reader) (records int64, firstError error, errOffset int64) {
+	cr := &countingReader{r: r}
+	reader := NewReader(bufio.NewReader(cr))
+	for reader.readNext(true) {
+		records++
+	}
+	if err := reader.Err(); err != nil {
+		return records, err, reader.CurrRecordPos
+	}
+	if cr.n > reader.NextRecordPos {
+		err := fmt.Errorf("%d bytes of incomplete header at the end", cr.n-reader.NextRecordPos)
+		return records, err, reader.NextRecordPos
+	}
+	return records, nil, -1
+}
+
+// ReverseReader reads records from the end of data towards the start,
+// e.g. to show the last records of a log file
+type ReverseReader struct {
+	r io.ReaderAt
+	// position of the last record read, size before the first ReadPrev
+	pos int64
+	// position of the record before pos, if already known, or -1
+	prev int64
+	// positions of records before pos, when they had to be found
+	// by reading headers from the start
+	offsets []int64
+	// data read at chunkPos, scanned for '\n' by findPrev
+	chunk     []byte
+	chunkPos  int64
+	hdrReader Reader
+	rec       Record
+}
+
+// NewReverseReader creates a reader for records in r, which has size bytes.
+// Records are found by scanning backwards from the end, so only the end
+// of data is read to get the last records
+func NewReverseReader(r io.ReaderAt, size int64) (*ReverseReader, error) {
+	rr := &ReverseReader{
+		r:    r,
+		pos:  size,
+		prev: -1,
+	}
+	if size > 0 {
+		if _, err := rr.prevPos(); err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+// endsAt returns true if there is a valid record header at pos in r
+// and the record ends exactly at end
+func (r *ReverseReader) endsAt(pos int64, end int64) bool {
+	recLen, err := recordLenAt(r.r, pos, &r.hdrReader)
+	return err == nil && pos+recLen == end
+}
+
+// chunkBefore returns data that ends at end, reading it from r.r
+// unless it's in the last chunk read
+func (r *ReverseReader) chunkBefore(end int64) ([]byte, int64, error) {
+	if len(r.chunk) > 0 && end > r.chunkPos && end <= r.chunkPos+int64(len(r.chunk)) {
+		return r.chunk[:end-r.chunkPos], r.chunkPos, nil
+	}
+	if r.chunk == nil {
+		r.chunk = make([]byte, 4096)
+	}
+	start := end - int64(cap(r.chunk))
+	if start < 0 {
+		start = 0
+	}
+	d := r.chunk[:cap(r.chunk)][:end-start]
+	n, err := r.r.ReadAt(d, start)
+	if n < len(d) {
+		r.chunk = r.chunk[:0]
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	r.chunk = d
+	r.chunkPos = start
+	return d, start, nil
+}
+
+// findPrev returns the position of the record that ends at r.pos.
+// A record starts at 0 or after '\n' so those are the candidates,
+// starting with the one closest to r.pos. A candidate is accepted if
+// its record ends exactly at r.pos.
+// Records written with Writer.NoPadding don't always start after '\n'.
+// If there is no candidate, positions are found by reading headers
+// from the start
+func (r *ReverseReader) findPrev() (int64, error) {
+	if n := len(r.offsets); n > 0 {
+		pos := r.offsets[n-1]
+		r.offsets = r.offsets[:n-1]
+		return pos, nil
+	}
+	end := r.pos
+	for end > 0 {
+		d, start, err := r.chunkBefore(end)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(d) - 1; i >= 0; i-- {
+			if d[i] != '\n' {
+				continue
+			}
+			pos := start + int64(i) + 1
+			if pos < r.pos && r.endsAt(pos, r.pos) {
+				return pos, nil
+			}
+		}
+		end = start
+	}
+	if r.endsAt(0, r.pos) {
+		return 0, nil
+	}
+
+	var offsets []int64
+	var pos int64
+	for pos < r.pos {
+		recLen, err := recordLenAt(r.r, pos, &r.hdrReader)
+		if err != nil {
+			return 0, fmt.Errorf("invalid record at position %d: %s", pos, err)
+		}
+		offsets = append(offsets, pos)
+		pos += recLen
+	}
+	if pos != r.pos {
+		return 0, fmt.Errorf("record at position %d ends after %d", offsets[len(offsets)-1], r.pos)
+	}
+	n := len(offsets)
+	r.offsets = offsets[:n-1]
+	return offsets[n-1], nil
+}
+
+// prevPos returns the position of the record before r.pos
+func (r *ReverseReader) prevPos() (int64, error) {
+	if r.prev < 0 {
+		pos, err := r.findPrev()
+		if err != nil {
+			return 0, err
+		}
+		r.prev = pos
+	}
+	return r.prev, nil
+}
+
+// ReadPrev reads the record before the last record read (the last record
+// in the data on first call). The record is valid until the next call.
+// Returns io.EOF when all records were read
+func (r *ReverseReader) ReadPrev() (*Record, error) {
+	if r.pos == 0 {
+		return nil, io.EOF
+	}
+	pos, err := r.prevPos()
+	if err != nil {
+		return nil, err
+	}
+	_, err = ReadRecordAt(r.r, pos, &r.rec)
+	if err != nil {
+		return nil, err
+	}
+	r.pos = pos
+	r.prev = -1
+	return &r.rec, nil
+}
@@ -0,0 +1,53 @@
+package siser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// MergeReaders reads records from srcs, each sorted by timestamp, and
+// writes them to dst sorted by timestamp. Records with the same
+// timestamp are written in the order of srcs.
+// Data of records is copied as is, with name and tags. Records written
+// with Writer.Delta can't be merged, because they depend on the previous
+// record in the source
+func MergeReaders(dst io.Writer, srcs ...io.Reader) error {
+	w := NewWriter(dst)
+	var readers []*Reader
+	for _, src := range srcs {
+		r := NewReader(bufio.NewReader(src))
+		if r.ReadNextData() {
+			readers = append(readers, r)
+		} else if err := r.Err(); err != nil {
+			return err
+		}
+	}
+	for len(readers) > 0 {
+		// there are usually few sources, so linear search for
+		// the earliest record is fast enough
+		idx := 0
+		for i, r := range readers[1:] {
+			if r.Timestamp.Before(readers[idx].Timestamp) {
+				idx = i + 1
+			}
+		}
+		r := readers[idx]
+		if _, ok := r.Tag(deltaTag); ok {
+			return fmt.Errorf("can't merge delta record at position %d", r.CurrRecordPos)
+		}
+		// don't make up a timestamp if it wasn't written
+		w.NoTimestamp = r.Timestamp.IsZero()
+		_, err := w.WriteTagged(r.Data, r.Timestamp, r.Name, r.Tags)
+		if err != nil {
+			return err
+		}
+		if !r.ReadNextData() {
+			if err = r.Err(); err != nil {
+				return err
+			}
+			readers = append(readers[:idx], readers[idx+1:]...)
+		}
+	}
+	return nil
+}
@@ -3,15 +3,23 @@ package siser
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/require"
@@ -81,6 +89,7 @@ func writeCorpus(d []byte) {
 
 func testRoundTrip(t *testing.T, r *Record) string {
 	d := r.Marshal()
+	assert.Equal(t, len(d), r.MarshalSize())
 	rec, err := UnmarshalRecord(d, nil)
 	assert.NoError(t, err)
 	rec2 := &Record{}
@@ -90,6 +99,8 @@ func testRoundTrip(t *testing.T, r *Record) string {
 	// name and timestamp are not serialized here
 	assert.Equal(t, rec.Entries, r.Entries)
 	assert.Equal(t, rec2.Entries, r.Entries)
+	// re-created from Entries
+	assert.Equal(t, d, rec.Marshal())
 
 	testWriterRoundTrip(t, r)
 	writeCorpus(d)
@@ -114,6 +125,106 @@ func TestUnmarshalErrors(t *testing.T) {
 	}
 }
 
+func TestLongValueNewlines(t *testing.T) {
+	tests := []struct {
+		value string
+		exp   string
+	}{
+		{"a\nb", "k:+3\na\nb\nnext: v\n"},
+		{"a\nb\n", "k:+4\na\nb\nnext: v\n"},
+		{"a\nb\n\n", "k:+5\na\nb\n\nnext: v\n"},
+		{"\n", "k:+1\n\nnext: v\n"},
+		{"\n\n", "k:+2\n\n\nnext: v\n"},
+	}
+	for _, test := range tests {
+		var r Record
+		r.Write("k", test.value, "next", "v")
+		s := testRoundTrip(t, &r)
+		assert.Equal(t, test.exp, s)
+		rec, err := UnmarshalRecordStrict([]byte(s), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, r.Entries, rec.Entries)
+	}
+}
+
+func TestUnmarshalEntries(t *testing.T) {
+	var r Record
+	r.Write("a", "1", "b", "2", "long", largeValue)
+	d := []byte(r.Marshal())
+
+	scratch := make([]Entry, 0, 3)
+	entries, err := UnmarshalEntries(d, scratch)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, entries)
+	// decoded in place
+	assert.True(t, &entries[0] == &scratch[:1][0])
+
+	// previous content is over-written, the slice grows if needed
+	entries, err = UnmarshalEntries([]byte("c: 3\n"), entries)
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{"c", "3"}}, entries)
+	entries, err = UnmarshalEntries(d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, entries)
+
+	_, err = UnmarshalEntries([]byte("c"), scratch)
+	assert.Error(t, err)
+}
+
+func TestUnmarshalErrorOffset(t *testing.T) {
+	tests := []struct {
+		s      string
+		offset int
+	}{
+		{"k: v\nk2", 5},
+		{"k: v\nk2: v2\nbad line\n", 12},
+		{"k: v\nk2:+5\nabc\n", 5},
+		{"k: v\nk2:+x\nabc\n", 5},
+		{"k:+3\nabck2:v\n", 8},
+		{"k=v\tk2\n", 4},
+		{"k=v\tk2=%zz\n", 7},
+	}
+	for _, test := range tests {
+		_, err := UnmarshalRecord([]byte(test.s), nil)
+		var perr *ParseError
+		assert.True(t, errors.As(err, &perr), "s: '%s'", test.s)
+		assert.Equal(t, test.offset, perr.Offset, "s: '%s'", test.s)
+		assert.Contains(t, err.Error(), "at offset")
+	}
+
+	_, err := UnmarshalRecordStrict([]byte("k:+3\nabck: v\n"), nil)
+	var perr *ParseError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, 8, perr.Offset)
+}
+
+func TestUnmarshalRecordStrict(t *testing.T) {
+	var r Record
+	// value ending with newline followed by an entry with empty value
+	r.Write("k", "a\n", "k2", "", "k3", "b", "k4", "c\nd")
+	d := r.Marshal()
+	assert.Equal(t, "k:+2\na\nk2:+0\nk3: b\nk4:+3\nc\nd\n", string(d))
+	rec, err := UnmarshalRecordStrict(d, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, rec.Entries)
+
+	invalid := []string{
+		// empty line that Marshal wouldn't write
+		"k:+2\na\n\nk2:+0\n",
+		"k2:+0\n\nk3: b\n",
+		// missing newline after value
+		"k:+1\nak2: v\n",
+		"k:+1\na",
+	}
+	for _, s := range invalid {
+		_, err = UnmarshalRecordStrict([]byte(s), nil)
+		assert.Error(t, err, "s: '%s'", s)
+		// lenient decoding accepts it
+		_, err = UnmarshalRecord([]byte(s), nil)
+		assert.NoError(t, err, "s: '%s'", s)
+	}
+}
+
 func testWriterRoundTrip(t *testing.T, r *Record) {
 	var buf bytes.Buffer
 	w := NewWriter(&buf)
@@ -122,8 +233,7 @@ func testWriterRoundTrip(t *testing.T, r *Record) {
 	d := buf.Bytes()
 	assert.Equal(t, len(d), n)
 
-	buf2 := bytes.NewBuffer(d)
-	reader := NewReader(bufio.NewReader(buf2))
+	reader := NewReaderBytes(d)
 	ok := reader.ReadNextRecord()
 	assert.True(t, ok)
 	rec := reader.Record
@@ -171,6 +281,7 @@ func readAndVerifyData(t *testing.T, buf *bytes.Buffer, tests []*testRec) int64
 		test := tests[n]
 		assert.Equal(t, test.s, string(r.Data))
 		assert.Equal(t, test.name, string(r.Name))
+		assert.Equal(t, len(test.s), r.DataLen())
 		assert.True(t, r.Timestamp.Equal(tm))
 		expPos := int64(test.pos)
 		assert.Equal(t, expPos, r.CurrRecordPos)
@@ -238,6 +349,9 @@ func TestRecordSerializeSimple(t *testing.T) {
 		assert.Equal(t, v, "")
 	}
 
+	assert.True(t, r.Has("key"))
+	assert.False(t, r.Has("Key"))
+
 	s := testRoundTrip(t, &r)
 	assert.Equal(t, "key: val\n", s)
 }
@@ -286,6 +400,479 @@ func TestWriterNoTimestamp(t *testing.T) {
 	}
 }
 
+func TestReadInvalidSize(t *testing.T) {
+	headers := []string{
+		"-5 123\n",
+		"-5\n",
+		"abc 123\nfoo\n",
+	}
+	for _, s := range headers {
+		r := NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+		assert.NotPanics(t, func() {
+			ok := r.ReadNextData()
+			assert.False(t, ok)
+		})
+		assert.Error(t, r.Err(), "s: '%s'", s)
+	}
+
+	r := NewReader(bufio.NewReader(bytes.NewBufferString("3 123\nfoo\n4 123\nfoo\n\n")))
+	r.MaxRecordSize = 3
+	assert.True(t, r.ReadNextData())
+	assert.False(t, r.ReadNextData())
+	assert.Error(t, r.Err())
+}
+
+func TestReadHugeSize(t *testing.T) {
+	// size bigger than the data must be an error, not a panic
+	// when allocating the buffer
+	sizes := []string{"9223372036854775807", "1073741824", "5000000"}
+	for _, size := range sizes {
+		s := size + " 123\nfoo\n"
+		r := NewReaderBytes([]byte(s))
+		assert.NotPanics(t, func() {
+			assert.False(t, r.ReadNextData())
+		})
+		assert.Equal(t, io.ErrUnexpectedEOF, r.Err(), "s: '%s'", s)
+
+		var rec Record
+		assert.NotPanics(t, func() {
+			_, _, err := UnmarshalFramed([]byte(s))
+			assert.Error(t, err)
+			_, err = ReadRecordAt(strings.NewReader(s), 0, &rec)
+			assert.Error(t, err)
+			_, err = ReadOneRecord(strings.NewReader(s), &rec, 0)
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+			_, err = ReadOneRecord(strings.NewReader(s), &rec, 1024)
+			assert.Error(t, err)
+		})
+	}
+
+	// records bigger than the pre-allocated buffer are still read
+	var rec Record
+	big := strings.Repeat("x", maxPreallocSize+10)
+	rec.Write("big", big)
+	d, err := rec.MarshalBinary()
+	assert.NoError(t, err)
+	r := NewReaderBytes(d)
+	assert.True(t, r.ReadNextRecord())
+	v, _ := r.Record.Get("big")
+	assert.Equal(t, big, v)
+	_, err = ReadOneRecord(bytes.NewReader(d), &rec, 0)
+	assert.NoError(t, err)
+	_, err = ReadOneRecord(bytes.NewReader(d), &rec, 1024)
+	assert.Error(t, err)
+}
+
+func TestNumberNamesNoTimestamp(t *testing.T) {
+	names := []string{"123", "7 days", "-5", "2024", " 123", "1a", "a 1"}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	for _, name := range names {
+		_, err := w.WriteStringNamed("foo", name)
+		assert.NoError(t, err)
+	}
+	assert.True(t, strings.HasPrefix(buf.String(), "3 %3123\nfoo\n3 %37 days\n"))
+
+	// read without the NoTimestamp hint
+	r := NewReaderBytes(buf.Bytes())
+	r.Strict = true
+	var got []string
+	for r.ReadNextData() {
+		assert.True(t, r.Timestamp.IsZero())
+		got = append(got, r.Name)
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, names, got)
+
+	// MergeReaders writes records without timestamp with NoTimestamp
+	var dst bytes.Buffer
+	assert.NoError(t, MergeReaders(&dst, bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, buf.String(), dst.String())
+}
+
+func TestHeaderNamesWithSpaces(t *testing.T) {
+	names := []string{"", "a b c", " leading", "trailing ", "  ", "a  b", "a   b ", " "}
+	for _, noTimestamp := range []bool{false, true} {
+		for _, name := range names {
+			for _, tags := range [][]Entry{nil, {{"k", "v"}}} {
+				var buf bytes.Buffer
+				w := NewWriter(&buf)
+				w.NoTimestamp = noTimestamp
+				tm := time.Unix(5, 0)
+				_, err := w.WriteTagged([]byte("foo"), tm, name, tags)
+				assert.NoError(t, err)
+
+				// Strict accepts everything written by Writer
+				r := NewReader(bufio.NewReader(&buf))
+				r.Strict = true
+				assert.True(t, r.ReadNextData(), "name: '%s'", name)
+				assert.NoError(t, r.Err(), "name: '%s'", name)
+				assert.Equal(t, name, r.Name, "name: '%s'", name)
+				assert.Equal(t, len(tags), len(r.Tags))
+				assert.Equal(t, !noTimestamp, r.Timestamp.Equal(tm))
+				assert.Equal(t, "foo", string(r.Data))
+			}
+		}
+	}
+
+	// extra spaces written by other writers
+	tests := []struct {
+		hdr  string
+		name string
+		tags int
+	}{
+		{"3 5000 \n", "", 0},
+		{"3  5000 name\n", "name", 0},
+		{"3 5000 name k=v \n", "name", 1},
+		{"3 5000 k=v  k2=v2\n", "", 2},
+	}
+	for _, test := range tests {
+		s := test.hdr + "foo\n"
+		r := NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+		assert.True(t, r.ReadNextData(), "hdr: '%s'", test.hdr)
+		assert.Equal(t, test.name, r.Name, "hdr: '%s'", test.hdr)
+		assert.Equal(t, test.tags, len(r.Tags), "hdr: '%s'", test.hdr)
+		assert.True(t, r.Timestamp.Equal(time.Unix(5, 0)))
+	}
+}
+
+func TestHeaderNameEscape(t *testing.T) {
+	names := []string{"a\nb", "100%", "a=b", "tab\there", "\x7f", "zażółć"}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, name := range names {
+		_, err := w.WriteStringNamed("foo", name)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, len(names), bytes.Count(buf.Bytes(), []byte("foo\n")))
+
+	r := NewReader(bufio.NewReader(&buf))
+	r.Strict = true
+	for _, name := range names {
+		assert.True(t, r.ReadNextData())
+		assert.Equal(t, name, r.Name)
+		assert.Equal(t, "foo", string(r.Data))
+		assert.Equal(t, 0, len(r.Tags))
+	}
+	assert.False(t, r.ReadNextData())
+	assert.NoError(t, r.Err())
+
+	// names with '%' written before we escaped them
+	r = NewReaderBytes([]byte("3 123 100%\nfoo\n"))
+	assert.True(t, r.ReadNextData())
+	assert.Equal(t, "100%", r.Name)
+}
+
+func TestReaderStrict(t *testing.T) {
+	tests := []struct {
+		hdr    string
+		strict bool
+	}{
+		{"3 123 name\n", true},
+		{"3 123 name a=b\n", true},
+		{"3 name with spaces\n", true},
+		{"3 123 name  a=b\n", false},
+		// Writer escapes the trailing space of name "name "
+		{"3 123 name \n", false},
+		{"3  123 name\n", false},
+		{"3 123 name=x y\n", false},
+	}
+	for _, test := range tests {
+		s := test.hdr + "foo\n"
+		r := NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+		assert.True(t, r.ReadNextData(), "hdr: '%s'", test.hdr)
+		assert.NoError(t, r.Err())
+
+		r = NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+		r.Strict = true
+		ok := r.ReadNextData()
+		assert.Equal(t, test.strict, ok, "hdr: '%s'", test.hdr)
+		assert.Equal(t, test.strict, r.Err() == nil, "hdr: '%s'", test.hdr)
+	}
+}
+
+func TestReaderDetectsNoTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	var tm time.Time
+	_, err := w.Write([]byte("foo"), tm, "name")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("bar"), tm, "")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("baz"), tm, "with spaces")
+	assert.NoError(t, err)
+	w.NoTimestamp = false
+	tm = time.Unix(5, 0)
+	_, err = w.Write([]byte("tm"), tm, "named")
+	assert.NoError(t, err)
+
+	r := NewReader(bufio.NewReader(&buf))
+	exp := []struct {
+		data string
+		name string
+	}{
+		{"foo", "name"},
+		{"bar", ""},
+		{"baz", "with spaces"},
+	}
+	for _, e := range exp {
+		assert.True(t, r.ReadNextData())
+		assert.Equal(t, e.data, string(r.Data))
+		assert.Equal(t, e.name, r.Name)
+		assert.True(t, r.Timestamp.IsZero())
+	}
+	assert.True(t, r.ReadNextData())
+	assert.Equal(t, "tm", string(r.Data))
+	assert.Equal(t, "named", r.Name)
+	assert.True(t, r.Timestamp.Equal(tm))
+	assert.False(t, r.ReadNextData())
+	assert.NoError(t, r.Err())
+}
+
+func TestWriteString(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	n, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	_, err = w.WriteStringNamed("bar\n", "name")
+	assert.NoError(t, err)
+	_, err = w.WriteString("")
+	assert.NoError(t, err)
+	assert.Equal(t, "3\nfoo\n4 name\nbar\n0\n", buf.String())
+}
+
+func TestWriterAutoFlush(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	w := NewWriter(bw)
+	w.NoTimestamp = true
+	_, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, buf.Len())
+
+	w.AutoFlush = true
+	_, err = w.WriteString("bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "3\nfoo\n3\nbar\n", buf.String())
+}
+
+// closeRecorder records calls to Flush, Sync and Close
+type closeRecorder struct {
+	bytes.Buffer
+	calls []string
+	err   error
+}
+
+func (w *closeRecorder) Flush() error {
+	w.calls = append(w.calls, "flush")
+	return w.err
+}
+
+func (w *closeRecorder) Sync() error {
+	w.calls = append(w.calls, "sync")
+	return nil
+}
+
+func (w *closeRecorder) Close() error {
+	w.calls = append(w.calls, "close")
+	return nil
+}
+
+func TestWriterClose(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	w := NewWriter(bw)
+	_, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, buf.Len())
+	assert.NoError(t, w.Close())
+	assert.True(t, buf.Len() > 0)
+
+	cr := &closeRecorder{}
+	w = NewWriter(cr)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, []string{"flush", "close"}, cr.calls)
+
+	cr = &closeRecorder{err: errors.New("flush failed")}
+	w = NewWriter(cr)
+	w.SyncOnClose = true
+	assert.Equal(t, cr.err, w.Close())
+	// closes even if flush fails
+	assert.Equal(t, []string{"flush", "sync", "close"}, cr.calls)
+
+	f, err := ioutil.TempFile("", "siser")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	w = NewWriter(f)
+	w.SyncOnClose = true
+	_, err = w.WriteString("foo")
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	_, err = f.Write([]byte("bar"))
+	assert.Error(t, err)
+	d, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	r := NewReaderBytes(d)
+	assert.True(t, r.ReadNextData())
+	assert.Equal(t, "foo", string(r.Data))
+}
+
+func TestWriteRecordTime(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("k", "v")
+	rec.Timestamp = time.Unix(5, 0)
+	tm := time.Unix(7, 0)
+	_, err := w.WriteRecordTime(&rec, tm)
+	assert.NoError(t, err)
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+
+	r := NewReaderBytes(buf.Bytes())
+	assert.True(t, r.ReadNextRecord())
+	assert.True(t, r.Record.Timestamp.Equal(tm))
+	assert.True(t, r.ReadNextRecord())
+	assert.True(t, r.Record.Timestamp.Equal(rec.Timestamp))
+}
+
+func TestWriteRecordTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("k", "v")
+	rec.Name = "name"
+	rec.Timestamp = time.Unix(5, 0)
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "5 5000 name\nk: v\n", buf.String())
+
+	// without Timestamp we use current time
+	rec.Timestamp = time.Time{}
+	before := time.Now()
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	after := time.Now()
+
+	r := NewReader(bufio.NewReader(&buf))
+	assert.True(t, r.ReadNextRecord())
+	assert.True(t, r.Record.Timestamp.Equal(time.Unix(5, 0)))
+	assert.True(t, r.ReadNextRecord())
+	got := r.Record.Timestamp
+	assert.False(t, got.Before(before.Truncate(time.Millisecond)))
+	assert.False(t, got.After(after))
+	assert.Equal(t, "name", r.Record.Name)
+	assert.False(t, r.ReadNextRecord())
+	assert.NoError(t, r.Err())
+}
+
+type failingWriter struct {
+	nWrites int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.nWrites++
+	return 0, errors.New("failed")
+}
+
+func TestTeeWriter(t *testing.T) {
+	var primary, mirror bytes.Buffer
+	w := NewWriter(NewTeeWriter(&primary, &mirror))
+	w.NoTimestamp = true
+	n, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, "3\nfoo\n", primary.String())
+	assert.Equal(t, "3\nfoo\n", mirror.String())
+
+	failing := &failingWriter{}
+	mirror.Reset()
+	tw := NewTeeWriter(&primary, failing, &mirror)
+	n, err = tw.Write([]byte("bar"))
+	assert.Error(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 0, mirror.Len())
+
+	tw.BestEffort = true
+	n, err = tw.Write([]byte("bar"))
+	assert.Error(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "bar", mirror.String())
+	assert.Equal(t, 2, failing.nWrites)
+
+	// primary failing
+	tw = NewTeeWriter(failing, &mirror)
+	_, err = tw.Write([]byte("bar"))
+	assert.Error(t, err)
+	assert.Equal(t, "bar", mirror.String())
+}
+
+func TestWriterInline(t *testing.T) {
+	var recs []*Record
+	{
+		var r Record
+		r.Write("k", "v", "key 2", "with spaces")
+		recs = append(recs, &r)
+	}
+	{
+		var r Record
+		r.Write("a:b", "c=d%", "tab\tkey", "v", "", "empty key")
+		recs = append(recs, &r)
+	}
+	{
+		// has long value, written in the basic format
+		var r Record
+		r.Write("k", "v", "long", "a\nb")
+		recs = append(recs, &r)
+	}
+	{
+		var r Record
+		recs = append(recs, &r)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	w.Inline = true
+	for _, r := range recs {
+		_, err := w.WriteRecord(r)
+		assert.NoError(t, err)
+	}
+	exp := ""
+	bodies := []string{
+		"k=v\tkey 2=with spaces\n",
+		"a%3Ab=c%3Dd%25\ttab%09key=v\t=empty key\n",
+		"k: v\nlong:+3\na\nb\n",
+		"",
+	}
+	for _, body := range bodies {
+		exp += strconv.Itoa(len(body)) + "\n" + body
+	}
+	assert.Equal(t, exp, buf.String())
+
+	r := NewReader(bufio.NewReader(&buf))
+	r.Strict = true
+	for _, rec := range recs {
+		assert.True(t, r.ReadNextRecord())
+		assert.Equal(t, len(rec.Entries), len(r.Record.Entries))
+		if len(rec.Entries) > 0 {
+			assert.Equal(t, rec.Entries, r.Record.Entries)
+		}
+	}
+	assert.False(t, r.ReadNextRecord())
+	assert.NoError(t, r.Err())
+
+	invalid := []string{"k\n", "k=%zz\n", "k=v\tk2\n"}
+	for _, s := range invalid {
+		_, err := UnmarshalRecord([]byte(s), nil)
+		assert.Error(t, err, "s: '%s'", s)
+	}
+}
+
 func TestRecordSerializeSimple3(t *testing.T) {
 	var r Record
 	r.Write("long key", largeValue)
@@ -313,74 +900,2458 @@ bu:   gatti
 	assert.Equal(t, exp, got)
 }
 
-func TestMany(t *testing.T) {
-	testMany(t, "")
-	testMany(t, "named")
-}
+func TestMarshalBinary(t *testing.T) {
+	var r Record
+	r.Write("k", "v", "long", largeValue)
+	r.Name = "named"
+	r.Timestamp = time.Unix(5, 0)
 
-func testMany(t *testing.T, name string) {
-	var buf bytes.Buffer
-	w := NewWriter(&buf)
+	var _ encoding.BinaryMarshaler = &r
+	var _ encoding.BinaryUnmarshaler = &r
 
-	// we can't compare timestamp directly but as truncated to milliseconds
-	now := time.Now()
+	d, err := r.MarshalBinary()
+	assert.NoError(t, err)
+	var r2 Record
+	err = r2.UnmarshalBinary(d)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, r2.Entries)
+	assert.Equal(t, r.Name, r2.Name)
+	assert.True(t, r.Timestamp.Equal(r2.Timestamp))
 
-	rec := &Record{}
-	var positions []int64
-	var currPos int64
-	nRecs := 8
-	for i := 0; i < nRecs; i++ {
-		rec.Reset()
-		rec.Name = name
-		rec.Timestamp = now
-		nRand := rand.Intn(1024)
-		rec.Write("counter", strconv.Itoa(i), "random", strconv.Itoa(nRand))
-		if i%12 == 0 {
-			rec.Write("large", largeValue)
-			// test a case where large value is last in the record as well
-			// as being followed by another value
-			if rand.Intn(1024) > 512 {
-				rec.Write("after", "whatever")
-			}
-		}
-		n, err := w.WriteRecord(rec)
-		assert.Nil(t, err)
-		positions = append(positions, currPos)
-		currPos += int64(n)
-	}
+	// record filled by Unmarshal must marshal to the same data
+	d2, err := r2.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, d, d2)
 
-	f := bufio.NewReader(bytes.NewBuffer(buf.Bytes()))
-	reader := NewReader(f)
-	i := 0
-	for reader.ReadNextRecord() {
-		rec := reader.Record
-		recPos := reader.CurrRecordPos
-		assert.Equal(t, recPos, positions[i])
-		if i < len(positions)-1 {
-			nextRecPos := reader.NextRecordPos
-			assert.Equal(t, nextRecPos, positions[i+1])
-		}
+	// zero timestamp is preserved
+	r.Timestamp = time.Time{}
+	d, err = r.MarshalBinary()
+	assert.NoError(t, err)
+	err = r2.UnmarshalBinary(d)
+	assert.NoError(t, err)
+	assert.True(t, r2.Timestamp.IsZero())
+	assert.Equal(t, r.Name, r2.Name)
 
-		counter, ok := rec.Get("counter")
-		assert.True(t, ok)
-		exp := strconv.Itoa(i)
-		assert.Equal(t, exp, counter)
-		_, ok = rec.Get("random")
-		assert.True(t, ok)
-		assert.Equal(t, rec.Name, name)
-		assert.True(t, timeDiffLessThanMs(rec.Timestamp, now), "timestamp: %s, now: %s", rec.Timestamp, now)
-		i++
+	// numeric name with zero timestamp is not read as a timestamp
+	for _, name := range []string{"2024", "7 days"} {
+		r.Name = name
+		d, err = r.MarshalBinary()
+		assert.NoError(t, err)
+		err = r2.UnmarshalBinary(d)
+		assert.NoError(t, err)
+		assert.True(t, r2.Timestamp.IsZero())
+		assert.Equal(t, name, r2.Name)
+		assert.Equal(t, r.Entries, r2.Entries)
 	}
-	assert.NoError(t, reader.Err())
-	assert.Equal(t, nRecs, i)
-}
 
-func TestWritePanics(t *testing.T) {
-	rec := &Record{}
-	assert.Panics(t, func() { rec.Write("foo") }, "should panic with even number of arguments")
+	assert.Error(t, r2.UnmarshalBinary(nil))
+	assert.Error(t, r2.UnmarshalBinary(append(d, 'a')))
 }
 
-func TestIntStrLen(t *testing.T) {
+func TestRoundTrip(t *testing.T) {
+	var r Record
+	got, err := RoundTrip(&r)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(got.Entries))
+
+	r.Write("k", "v", "empty", "", "long", largeValue, "nl", "ends with newline\n")
+	r.Name = "name with spaces"
+	r.Tags = []Entry{{"level", "info"}}
+	r.Timestamp = time.Unix(5, 1000)
+	got, err = RoundTrip(&r)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, got.Entries)
+	assert.Equal(t, r.Name, got.Name)
+	assert.Equal(t, r.Tags, got.Tags)
+	assert.True(t, got.Timestamp.Equal(time.Unix(5, 0)))
+
+	// names that are hard to encode in the header
+	names := []string{" leading", "trailing ", "a  b", "2024", "7 days", "-1"}
+	for _, ts := range []time.Time{{}, time.Unix(5, 0)} {
+		for _, name := range names {
+			r.Name = name
+			r.Timestamp = ts
+			got, err = RoundTrip(&r)
+			assert.NoError(t, err, "name: '%s'", name)
+			assert.Equal(t, name, got.Name)
+			assert.True(t, got.Timestamp.Equal(ts), "name: '%s'", name)
+			assert.Equal(t, r.Entries, got.Entries)
+		}
+	}
+}
+
+func TestHeaderTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []Entry
+	}{
+		{"", []Entry{{"level", "info"}}},
+		{"named", []Entry{{"level", "info"}, {"trace_id", "a b=c%\n"}}},
+		{"with spaces", []Entry{{"", ""}}},
+		{"no tags", nil},
+	}
+	for _, noTimestamp := range []bool{false, true} {
+		for _, test := range tests {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.NoTimestamp = noTimestamp
+			var rec Record
+			rec.Write("k", "v")
+			rec.Name = test.name
+			rec.Tags = test.tags
+			_, err := w.WriteRecord(&rec)
+			assert.NoError(t, err)
+
+			r := NewReader(bufio.NewReader(&buf))
+			ok := r.ReadNextRecord()
+			assert.True(t, ok)
+			assert.NoError(t, r.Err())
+			assert.Equal(t, test.name, r.Record.Name)
+			assert.Equal(t, len(test.tags), len(r.Record.Tags))
+			for _, e := range test.tags {
+				v, ok := r.Tag(e.Key)
+				assert.True(t, ok)
+				assert.Equal(t, e.Value, v)
+				v, ok = r.Record.Tag(e.Key)
+				assert.True(t, ok)
+				assert.Equal(t, e.Value, v)
+			}
+			v, ok := r.Record.Get("k")
+			assert.True(t, ok)
+			assert.Equal(t, "v", v)
+		}
+	}
+
+	r := NewReader(bufio.NewReader(bytes.NewBufferString("3 123 name a=%zz\nfoo\n")))
+	assert.False(t, r.ReadNextData())
+	assert.Error(t, r.Err())
+}
+
+func TestRecordHash(t *testing.T) {
+	var r1, r2 Record
+	assert.Equal(t, r1.Hash(), r2.Hash())
+	r1.Write("a", "1", "b", "2", "a", "3")
+	r2.Write("b", "2", "a", "1", "a", "3")
+	assert.Equal(t, r1.Hash(), r2.Hash())
+	assert.Equal(t, r1.HashWithMeta(), r2.HashWithMeta())
+
+	// order of values of the same key matters
+	var r3 Record
+	r3.Write("a", "3", "b", "2", "a", "1")
+	assert.NotEqual(t, r1.Hash(), r3.Hash())
+
+	// entries are not ambiguous
+	var r4, r5 Record
+	r4.Write("a", "1\nb: 2")
+	r5.Write("a", "1", "b", "2")
+	assert.NotEqual(t, r4.Hash(), r5.Hash())
+
+	h := r1.HashWithMeta()
+	r2.Name = "named"
+	assert.Equal(t, r1.Hash(), r2.Hash())
+	assert.NotEqual(t, h, r2.HashWithMeta())
+	r2.Name = ""
+	r2.Timestamp = time.Unix(5, 0)
+	assert.NotEqual(t, h, r2.HashWithMeta())
+	r1.Timestamp = time.Unix(5, 1000)
+	assert.Equal(t, r1.HashWithMeta(), r2.HashWithMeta())
+	r2.Tags = []Entry{{"level", "info"}, {"host", "a"}}
+	assert.NotEqual(t, r1.HashWithMeta(), r2.HashWithMeta())
+	r1.Tags = []Entry{{"host", "a"}, {"level", "info"}}
+	assert.Equal(t, r1.HashWithMeta(), r2.HashWithMeta())
+	assert.Equal(t, []Entry{{"level", "info"}, {"host", "a"}}, r2.Tags)
+
+	// hashing doesn't change entries
+	assert.Equal(t, "b", r2.Entries[0].Key)
+}
+
+func TestRecordToJSONObject(t *testing.T) {
+	var r Record
+	d, err := r.ToJSONObject()
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(d))
+
+	r.Write("uri", "/atom.xml", "code", "200", "ua", "Mozilla \"5.0\"\n", "code", "404")
+	d, err = r.ToJSONObject()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uri":"/atom.xml","code":"200","ua":"Mozilla \"5.0\"\n"}`, string(d))
+
+	d, err = r.ToJSONObject("code", "missing", "uri", "code")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"code":"200","uri":"/atom.xml"}`, string(d))
+	var m map[string]string
+	assert.NoError(t, json.Unmarshal(d, &m))
+	assert.Equal(t, map[string]string{"code": "200", "uri": "/atom.xml"}, m)
+}
+
+func TestRecordString(t *testing.T) {
+	var r Record
+	assert.Equal(t, "{}", r.String())
+	r.Write("k", "v", "empty", "", "multi", "a\nb", "comma", "a, b")
+	assert.Equal(t, `{k: v, empty: "", multi: "a\nb", comma: "a, b"}`, r.String())
+	r.Name = "named"
+	r.Timestamp = time.Unix(5, 0).UTC()
+	r.Tags = []Entry{{"level", "info"}}
+	assert.Equal(t, `named 1970-01-01T00:00:05Z level=info {k: v, empty: "", multi: "a\nb", comma: "a, b"}`, r.String())
+	assert.Equal(t, r.String(), fmt.Sprintf("%v", &r))
+
+	// name is escaped like values
+	r.Name = "two\nlines"
+	r.Tags = nil
+	r.Timestamp = time.Time{}
+	assert.Equal(t, `"two\nlines" {k: v, empty: "", multi: "a\nb", comma: "a, b"}`, r.String())
+}
+
+func TestRecordFilter(t *testing.T) {
+	var r Record
+	r.Write("a", "1", "password", "secret", "b", "2", "a", "3")
+	r.Name = "named"
+	r.Timestamp = time.Unix(5, 0)
+
+	r2 := r.Filter(func(key, value string) bool {
+		return key != "password"
+	})
+	exp := []Entry{{"a", "1"}, {"b", "2"}, {"a", "3"}}
+	assert.Equal(t, exp, r2.Entries)
+	assert.Equal(t, r.Name, r2.Name)
+	assert.True(t, r.Timestamp.Equal(r2.Timestamp))
+	assert.Equal(t, "a: 1\nb: 2\na: 3\n", string(r2.Marshal()))
+	// original is not modified
+	assert.Equal(t, 4, len(r.Entries))
+
+	r2 = r.FilterKeys("b", "password")
+	exp = []Entry{{"password", "secret"}, {"b", "2"}}
+	assert.Equal(t, exp, r2.Entries)
+
+	r2 = r.FilterKeys()
+	assert.Equal(t, 0, len(r2.Entries))
+}
+
+func TestRecordWritef(t *testing.T) {
+	var r Record
+	r.Writef("latency", "%.2fms", 1.414)
+	r.Writef("plain", "no args")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "latency: 1.41ms\nplain: no args\n", s)
+}
+
+type testPoint struct {
+	x, y int
+}
+
+func (p testPoint) SiserValue() string {
+	return fmt.Sprintf("%d,%d", p.x, p.y)
+}
+
+func (p *testPoint) parse(s string) error {
+	_, err := fmt.Sscanf(s, "%d,%d", &p.x, &p.y)
+	return err
+}
+
+func TestRecordWriteValue(t *testing.T) {
+	var r Record
+	r.WriteValue("p", testPoint{1, 2})
+	r.Write("bad", "x")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "p: 1,2\nbad: x\n", s)
+
+	var p testPoint
+	ok, err := r.GetValue("p", p.parse)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, testPoint{1, 2}, p)
+
+	ok, err = r.GetValue("missing", p.parse)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = r.GetValue("bad", p.parse)
+	assert.True(t, ok)
+	assert.Error(t, err)
+}
+
+func TestRecordWriteError(t *testing.T) {
+	var r Record
+	r.WriteError("err", errors.New("failed\nstack trace"))
+	r.WriteError("noerr", nil)
+	testRoundTrip(t, &r)
+	v, ok := r.Get("err")
+	assert.True(t, ok)
+	assert.Equal(t, "failed\nstack trace", v)
+	v, ok = r.Get("noerr")
+	assert.True(t, ok)
+	assert.Equal(t, "<nil>", v)
+}
+
+func TestRecordSortEntries(t *testing.T) {
+	var r Record
+	r.Write("b", "1", "a", "2", "b", "3", "c", "4", "a", "5")
+	r.SortEntries()
+	exp := []Entry{{"a", "2"}, {"a", "5"}, {"b", "1"}, {"b", "3"}, {"c", "4"}}
+	assert.Equal(t, exp, r.Entries)
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 2\na: 5\nb: 1\nb: 3\nc: 4\n", s)
+}
+
+func TestRecordSortFunc(t *testing.T) {
+	var r Record
+	r.Write("user", "me", "level", "info", "msg", "hello", "timestamp", "123", "app", "web")
+	// force marshaling so that we verify it's re-created after sort
+	_ = r.Marshal()
+	first := map[string]int{"timestamp": 1, "level": 2}
+	r.SortFunc(func(a, b Entry) bool {
+		ra, rb := first[a.Key], first[b.Key]
+		if ra == 0 || rb == 0 {
+			if ra != rb {
+				return ra != 0
+			}
+			return a.Key < b.Key
+		}
+		return ra < rb
+	})
+	keys := make([]string, len(r.Entries))
+	for i, e := range r.Entries {
+		keys[i] = e.Key
+	}
+	assert.Equal(t, []string{"timestamp", "level", "app", "msg", "user"}, keys)
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "timestamp: 123\nlevel: info\napp: web\nmsg: hello\nuser: me\n", s)
+}
+
+func TestMarshalText(t *testing.T) {
+	var r Record
+	r.Write("k", "v", "k2", "a\nb")
+	r.Name = "named"
+
+	var _ encoding.TextMarshaler = &r
+	var _ encoding.TextUnmarshaler = &r
+
+	d, err := r.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "k: v\nk2:+3\na\nb\n", string(d))
+	var r2 Record
+	err = r2.UnmarshalText(d)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, r2.Entries)
+	assert.Equal(t, "", r2.Name)
+	assert.Error(t, r2.UnmarshalText([]byte("k")))
+}
+
+func TestRecordTime(t *testing.T) {
+	var r Record
+	tm := time.Date(2019, 3, 25, 4, 33, 55, 903000000, time.UTC)
+	r.WriteTime("t", tm)
+	r.WriteTimeLayout("day", tm, "2006-01-02")
+	r.Write("bad", "not a time")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "t: 2019-03-25T04:33:55.903Z\nday: 2019-03-25\nbad: not a time\n", s)
+
+	got, ok, err := r.GetTime("t")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.True(t, tm.Equal(got))
+
+	got, ok, err = r.GetTimeLayout("day", "2006-01-02")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.True(t, tm.Truncate(24*time.Hour).Equal(got))
+
+	_, ok, err = r.GetTime("missing")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	_, ok, err = r.GetTime("bad")
+	assert.True(t, ok)
+	assert.Error(t, err)
+}
+
+func TestRecordRename(t *testing.T) {
+	var r Record
+	r.Write("URL", "/a", "code", "200", "URL", "/b")
+	assert.True(t, r.Rename("URL", "url"))
+	assert.False(t, r.Rename("missing", "url"))
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "url: /a\ncode: 200\nURL: /b\n", s)
+
+	assert.Equal(t, 1, r.RenameAll("URL", "url"))
+	assert.Equal(t, 2, r.RenameAll("url", "u"))
+	assert.Equal(t, 0, r.RenameAll("url", "u"))
+	s = testRoundTrip(t, &r)
+	assert.Equal(t, "u: /a\ncode: 200\nu: /b\n", s)
+}
+
+func TestRecordPool(t *testing.T) {
+	r := GetRecord()
+	assert.Equal(t, 0, len(r.Entries))
+	r.Write("k", "v")
+	r.Name = "name"
+	PutRecord(r)
+	r = GetRecord()
+	assert.Equal(t, 0, len(r.Entries))
+	assert.Equal(t, "", r.Name)
+	assert.Equal(t, 0, len(r.Marshal()))
+	PutRecord(r)
+}
+
+func TestRecordEmptyValue(t *testing.T) {
+	var r Record
+	r.Write("empty", "", "k", "v")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "empty:+0\nk: v\n", s)
+
+	rec, err := UnmarshalRecord([]byte(s), nil)
+	assert.NoError(t, err)
+	v, ok := rec.Get("empty")
+	assert.True(t, ok)
+	assert.Equal(t, "", v)
+	v, ok = rec.Get("missing")
+	assert.False(t, ok)
+	assert.Equal(t, "", v)
+}
+
+func TestRecordInsertAt(t *testing.T) {
+	var r Record
+	r.Write("b", "2")
+	assert.NoError(t, r.InsertAt(0, "a", "1"))
+	assert.NoError(t, r.InsertAt(2, "d", "4"))
+	assert.NoError(t, r.InsertAt(2, "c", "3"))
+	assert.Error(t, r.InsertAt(5, "e", "5"))
+	assert.Error(t, r.InsertAt(-1, "e", "5"))
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 1\nb: 2\nc: 3\nd: 4\n", s)
+}
+
+func TestRecordTrim(t *testing.T) {
+	var r Record
+	r.Write(" a ", "  1\n", "b", "2", "c", " \t")
+	r.Trim()
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, " a : 1\nb: 2\nc:+0\n", s)
+	r.TrimKeys()
+	s = testRoundTrip(t, &r)
+	assert.Equal(t, "a: 1\nb: 2\nc:+0\n", s)
+}
+
+func TestRecordDuplicateKeys(t *testing.T) {
+	var r Record
+	assert.False(t, r.HasDuplicateKeys())
+	assert.Nil(t, r.DuplicateKeys())
+	r.Write("a", "1", "b", "2")
+	assert.False(t, r.HasDuplicateKeys())
+	r.Write("b", "3", "a", "4", "b", "5")
+	assert.True(t, r.HasDuplicateKeys())
+	assert.Equal(t, []string{"b", "a"}, r.DuplicateKeys())
+}
+
+func TestRecordRangeValues(t *testing.T) {
+	var r Record
+	r.Write("h", "1", "a", "x", "h", "2", "h", "3")
+	var got []string
+	r.RangeValues("h", func(v string) bool {
+		got = append(got, v)
+		return true
+	})
+	assert.Equal(t, []string{"1", "2", "3"}, got)
+
+	got = nil
+	r.RangeValues("h", func(v string) bool {
+		got = append(got, v)
+		return len(got) < 2
+	})
+	assert.Equal(t, []string{"1", "2"}, got)
+
+	r.RangeValues("missing", func(v string) bool {
+		t.Fatal("shouldn't be called")
+		return true
+	})
+}
+
+func TestRecordCompact(t *testing.T) {
+	var r Record
+	r.Compact()
+	assert.Equal(t, 0, len(r.Entries))
+
+	r.Write("a", "1", "b", "2", "c", "3", "b", "4", "a", "5", "d", "6", "b", "7")
+	r.Compact()
+	assert.False(t, r.HasDuplicateKeys())
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 5\nb: 7\nc: 3\nd: 6\n", s)
+
+	// no duplicates, no change
+	r.Compact()
+	s = testRoundTrip(t, &r)
+	assert.Equal(t, "a: 5\nb: 7\nc: 3\nd: 6\n", s)
+}
+
+func TestRecordDuration(t *testing.T) {
+	var r Record
+	durations := []time.Duration{0, 1410 * time.Microsecond, -time.Nanosecond, 26*time.Hour + time.Nanosecond, math.MaxInt64, math.MinInt64}
+	for i, d := range durations {
+		r.WriteDuration(strconv.Itoa(i), d)
+	}
+	r.Write("bad", "1.41")
+	testRoundTrip(t, &r)
+	v, _ := r.Get("1")
+	assert.Equal(t, "1.41ms", v)
+
+	for i, exp := range durations {
+		got, ok, err := r.GetDuration(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		assert.Equal(t, exp, got)
+	}
+	_, ok, err := r.GetDuration("missing")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	_, ok, err = r.GetDuration("bad")
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	var d time.Duration
+	assert.NoError(t, r.Scan([]string{"1"}, &d))
+	assert.Equal(t, durations[1], d)
+}
+
+func TestRecordGetFold(t *testing.T) {
+	var r Record
+	r.Write("Content-Type", "text/html", "content-type", "text/plain")
+	v, ok := r.GetFold("content-type")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", v)
+	v, ok = r.GetFold("CONTENT-TYPE")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", v)
+	_, ok = r.GetFold("content")
+	assert.False(t, ok)
+
+	// Get is still case-sensitive
+	v, ok = r.Get("content-type")
+	assert.True(t, ok)
+	assert.Equal(t, "text/plain", v)
+	_, ok = r.Get("CONTENT-TYPE")
+	assert.False(t, ok)
+}
+
+func TestRecordGetOr(t *testing.T) {
+	var r Record
+	r.Write("s", "str", "empty", "", "code", "200", "dur", "1.41")
+	assert.Equal(t, "str", r.GetOr("s", "def"))
+	assert.Equal(t, "", r.GetOr("empty", "def"))
+	assert.Equal(t, "def", r.GetOr("missing", "def"))
+
+	assert.Equal(t, 200, r.GetIntOr("code", 5))
+	assert.Equal(t, 5, r.GetIntOr("missing", 5))
+	assert.Equal(t, 5, r.GetIntOr("dur", 5))
+
+	assert.Equal(t, 1.41, r.GetFloatOr("dur", 2.5))
+	assert.Equal(t, 200.0, r.GetFloatOr("code", 2.5))
+	assert.Equal(t, 2.5, r.GetFloatOr("missing", 2.5))
+	assert.Equal(t, 2.5, r.GetFloatOr("s", 2.5))
+}
+
+func TestRecordScan(t *testing.T) {
+	var r Record
+	tm := time.Date(2019, 3, 25, 4, 33, 55, 0, time.UTC)
+	r.Write("s", "str", "code", "200", "size", "35286", "dur", "1.41", "ok", "true")
+	r.WriteTime("when", tm)
+
+	var s string
+	var code int
+	var size int64
+	var dur float64
+	var ok bool
+	var when time.Time
+	keys := []string{"s", "code", "size", "dur", "ok", "when"}
+	err := r.Scan(keys, &s, &code, &size, &dur, &ok, &when)
+	assert.NoError(t, err)
+	assert.Equal(t, "str", s)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, int64(35286), size)
+	assert.Equal(t, 1.41, dur)
+	assert.True(t, ok)
+	assert.True(t, tm.Equal(when))
+
+	assert.Error(t, r.Scan([]string{"s"}, &code))
+	assert.Error(t, r.Scan([]string{"missing"}, &s))
+	assert.Error(t, r.Scan([]string{"s", "code"}, &s))
+	var u uint
+	assert.Error(t, r.Scan([]string{"code"}, &u))
+}
+
+func TestMany(t *testing.T) {
+	testMany(t, "")
+	testMany(t, "named")
+}
+
+func testMany(t *testing.T, name string) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	// we can't compare timestamp directly but as truncated to milliseconds
+	now := time.Now()
+
+	rec := &Record{}
+	var positions []int64
+	var currPos int64
+	nRecs := 8
+	for i := 0; i < nRecs; i++ {
+		rec.Reset()
+		rec.Name = name
+		rec.Timestamp = now
+		nRand := rand.Intn(1024)
+		rec.Write("counter", strconv.Itoa(i), "random", strconv.Itoa(nRand))
+		if i%12 == 0 {
+			rec.Write("large", largeValue)
+			// test a case where large value is last in the record as well
+			// as being followed by another value
+			if rand.Intn(1024) > 512 {
+				rec.Write("after", "whatever")
+			}
+		}
+		n, err := w.WriteRecord(rec)
+		assert.Nil(t, err)
+		positions = append(positions, currPos)
+		currPos += int64(n)
+	}
+
+	f := bufio.NewReader(bytes.NewBuffer(buf.Bytes()))
+	reader := NewReader(f)
+	i := 0
+	for reader.ReadNextRecord() {
+		rec := reader.Record
+		recPos := reader.CurrRecordPos
+		assert.Equal(t, recPos, positions[i])
+		if i < len(positions)-1 {
+			nextRecPos := reader.NextRecordPos
+			assert.Equal(t, nextRecPos, positions[i+1])
+		}
+
+		counter, ok := rec.Get("counter")
+		assert.True(t, ok)
+		exp := strconv.Itoa(i)
+		assert.Equal(t, exp, counter)
+		_, ok = rec.Get("random")
+		assert.True(t, ok)
+		assert.Equal(t, rec.Name, name)
+		assert.True(t, timeDiffLessThanMs(rec.Timestamp, now), "timestamp: %s, now: %s", rec.Timestamp, now)
+		i++
+	}
+	assert.NoError(t, reader.Err())
+	assert.Equal(t, nRecs, i)
+}
+
+func TestReadRecordAt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var positions []int64
+	var currPos int64
+	for i := 0; i < 5; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		rec.Name = "rec" + strconv.Itoa(i)
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		positions = append(positions, currPos)
+		currPos += int64(n)
+	}
+
+	d := bytes.NewReader(buf.Bytes())
+	var rec Record
+	for i := len(positions) - 1; i >= 0; i-- {
+		n, err := ReadRecordAt(d, positions[i], &rec)
+		assert.NoError(t, err)
+		if i < len(positions)-1 {
+			assert.Equal(t, positions[i+1]-positions[i], int64(n))
+		}
+		v, ok := rec.Get("counter")
+		assert.True(t, ok)
+		assert.Equal(t, strconv.Itoa(i), v)
+		assert.Equal(t, "rec"+strconv.Itoa(i), rec.Name)
+	}
+
+	_, err := ReadRecordAt(d, currPos, &rec)
+	assert.Equal(t, io.EOF, err)
+	_, err = ReadRecordAt(d, 1, &rec)
+	assert.Error(t, err)
+	for _, offset := range []int64{-1, math.MinInt64} {
+		assert.NotPanics(t, func() {
+			_, err = ReadRecordAt(d, offset, &rec)
+		})
+		assert.Error(t, err)
+	}
+}
+
+func TestReadCorruptBody(t *testing.T) {
+	// declared size cuts the long value short
+	s := "8 123\nk:+5\nabc\nd: e\n"
+	r := NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+	assert.False(t, r.ReadNextRecord())
+	assert.Error(t, r.Err())
+}
+
+func TestBuildIndex(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var currPos int64
+	exp := map[string][]int64{}
+	for i := 0; i < 9; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		if i%3 == 0 {
+			rec.Write("large", largeValue+"\n")
+		}
+		rec.Name = "rec" + strconv.Itoa(i%3)
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		exp[rec.Name] = append(exp[rec.Name], currPos)
+		currPos += int64(n)
+	}
+	_, err := w.Write(nil, time.Time{}, "empty")
+	assert.NoError(t, err)
+	exp["empty"] = []int64{currPos}
+
+	d := buf.Bytes()
+	idx, err := BuildIndex(bytes.NewReader(d))
+	assert.NoError(t, err)
+	assert.Equal(t, len(exp), len(idx.Names()))
+	for name, positions := range exp {
+		assert.Equal(t, positions, idx.Lookup(name))
+	}
+	assert.Nil(t, idx.Lookup("missing"))
+
+	var rec Record
+	for _, pos := range idx.Lookup("rec1") {
+		_, err = ReadRecordAt(bytes.NewReader(d), pos, &rec)
+		assert.NoError(t, err)
+		assert.Equal(t, "rec1", rec.Name)
+	}
+
+	// truncated in the middle of large value
+	_, err = BuildIndex(bytes.NewReader(d[:exp["rec0"][1]+100]))
+	assert.Error(t, err)
+}
+
+func TestReverseReader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < 5; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		if i == 2 {
+			rec.Write("large", largeValue)
+		}
+		rec.Name = "rec" + strconv.Itoa(i)
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+	r, err := NewReverseReader(bytes.NewReader(d), int64(len(d)))
+	assert.NoError(t, err)
+	for i := 4; i >= 0; i-- {
+		rec, err := r.ReadPrev()
+		assert.NoError(t, err)
+		assert.Equal(t, "rec"+strconv.Itoa(i), rec.Name)
+		v, _ := rec.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+	_, err = r.ReadPrev()
+	assert.Equal(t, io.EOF, err)
+
+	r, err = NewReverseReader(bytes.NewReader(nil), 0)
+	assert.NoError(t, err)
+	_, err = r.ReadPrev()
+	assert.Equal(t, io.EOF, err)
+
+	// size in the middle of a record
+	_, err = NewReverseReader(bytes.NewReader(d), int64(len(d)-2))
+	assert.Error(t, err)
+	_, err = NewReverseReader(bytes.NewReader(d[:len(d)-2]), int64(len(d)))
+	assert.Error(t, err)
+}
+
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.n += int64(n)
+	return n, err
+}
+
+// reversePositions returns positions of records in d, as found
+// by ReverseReader
+func reversePositions(t *testing.T, d []byte) []int64 {
+	rr, err := NewReverseReader(bytes.NewReader(d), int64(len(d)))
+	assert.NoError(t, err)
+	var res []int64
+	for err == nil && rr.pos > 0 {
+		var pos int64
+		pos, err = rr.prevPos()
+		assert.NoError(t, err)
+		res = append([]int64{pos}, res...)
+		rr.pos = pos
+		rr.prev = -1
+	}
+	return res
+}
+
+func TestReverseReaderReadsEnd(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	for i := 0; i < 1000; i++ {
+		rec.Reset()
+		rec.Write("counter", strconv.Itoa(i), "text", "line 1\nline 2\n")
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+	cr := &countingReaderAt{r: bytes.NewReader(d)}
+	rr, err := NewReverseReader(cr, int64(len(d)))
+	assert.NoError(t, err)
+	for i := 999; i >= 990; i-- {
+		rec, err := rr.ReadPrev()
+		assert.NoError(t, err)
+		v, _ := rec.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+	assert.True(t, cr.n < int64(len(d))/4, "read %d of %d bytes", cr.n, len(d))
+	assert.Equal(t, 1000, len(reversePositions(t, d)))
+}
+
+func TestReadMaxRecordEntries(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("a", "1", "b", "2")
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Write("c", "3")
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+
+	r := NewReaderBytes(buf.Bytes())
+	r.MaxRecordEntries = 2
+	assert.True(t, r.ReadNextRecord())
+	assert.False(t, r.ReadNextRecord())
+	assert.Error(t, r.Err())
+
+	// the limit applies to the full record, not the delta
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Delta = true
+	rec.Reset()
+	rec.Write("a", "1", "b", "2")
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Write("c", "3")
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "siser.delta")
+
+	r = NewReaderBytes(buf.Bytes())
+	r.MaxRecordEntries = 2
+	assert.True(t, r.ReadNextRecord())
+	assert.False(t, r.ReadNextRecord())
+	assert.Error(t, r.Err())
+}
+
+func TestReaderRecords(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	for i := 0; i < 10; i++ {
+		rec.Reset()
+		rec.Write("counter", strconv.Itoa(i))
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	recs, errc := NewReaderBytes(d).Records(2, nil)
+	var got []*Record
+	for rec := range recs {
+		got = append(got, rec)
+	}
+	assert.NoError(t, <-errc)
+	assert.Equal(t, 10, len(got))
+	for i, rec := range got {
+		v, _ := rec.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+
+	recs, errc = NewReaderBytes(d[:len(d)-3]).Records(0, nil)
+	n := 0
+	for range recs {
+		n++
+	}
+	assert.Equal(t, 9, n)
+	assert.Error(t, <-errc)
+
+	// stop receiving early
+	done := make(chan struct{})
+	r := NewReaderBytes(d)
+	recs, errc = r.Records(0, done)
+	<-recs
+	close(done)
+	// we don't receive, so the goroutine can only stop
+	assert.NoError(t, <-errc)
+	assert.False(t, r.Done())
+	_, ok := <-recs
+	assert.False(t, ok)
+}
+
+func TestRecordCopyTo(t *testing.T) {
+	var r Record
+	r.Write("a", "1", "b", "2")
+	r.Name = "named"
+	r.Timestamp = time.Unix(5, 0)
+	r.Tags = []Entry{{"level", "info"}}
+
+	dst := GetRecord()
+	defer PutRecord(dst)
+	dst.Write("x", "1", "y", "2", "z", "3")
+	dst.Tags = append(dst.Tags, Entry{"t", "v"})
+	entries := &dst.Entries[0]
+	r.CopyTo(dst)
+	// re-uses the memory of dst
+	assert.True(t, entries == &dst.Entries[0])
+	assert.Equal(t, r.Entries, dst.Entries)
+	assert.Equal(t, r.Tags, dst.Tags)
+	assert.Equal(t, r.Name, dst.Name)
+	assert.True(t, r.Timestamp.Equal(dst.Timestamp))
+	assert.Equal(t, "a: 1\nb: 2\n", string(dst.Marshal()))
+
+	// a deep copy
+	dst.Entries[0].Value = "changed"
+	dst.Tags[0].Value = "changed"
+	v, _ := r.Get("a")
+	assert.Equal(t, "1", v)
+	assert.Equal(t, "info", r.Tags[0].Value)
+
+	r.CopyTo(&r)
+	assert.Equal(t, 2, len(r.Entries))
+}
+
+func TestRecordClone(t *testing.T) {
+	var r Record
+	r.Write("k", "v")
+	r.Name = "name"
+	r.Tags = []Entry{{"t", "v"}}
+	r2 := r.Clone()
+	r.Reset()
+	r.Write("k2", "v2")
+	assert.Equal(t, []Entry{{"k", "v"}}, r2.Entries)
+	assert.Equal(t, []Entry{{"t", "v"}}, r2.Tags)
+	assert.Equal(t, "name", r2.Name)
+	assert.Equal(t, "k: v\n", string(r2.Marshal()))
+}
+
+func TestReaderMaxBufferReuse(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < 3; i++ {
+		_, err := w.Write([]byte(largeValue), time.Time{}, "")
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	readAll := func(maxReuse int64) bool {
+		r := NewReaderBytes(d)
+		r.MaxBufferReuse = maxReuse
+		assert.True(t, r.ReadNextData())
+		prev := &r.Data[0]
+		reused := true
+		for r.ReadNextData() {
+			reused = reused && prev == &r.Data[0]
+		}
+		assert.NoError(t, r.Err())
+		return reused
+	}
+	assert.True(t, readAll(DefaultMaxBufferReuse))
+	assert.True(t, readAll(0))
+	assert.False(t, readAll(-1))
+	assert.False(t, readAll(10))
+}
+
+func TestUnmarshalFramed(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	for i := 0; i < 3; i++ {
+		rec.Reset()
+		rec.Write("counter", strconv.Itoa(i))
+		rec.Name = "name"
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+
+	d := buf.Bytes()
+	i := 0
+	for len(d) > 0 {
+		rec, n, err := UnmarshalFramed(d)
+		assert.NoError(t, err)
+		v, _ := rec.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+		assert.Equal(t, "name", rec.Name)
+		d = d[n:]
+		i++
+	}
+	assert.Equal(t, 3, i)
+
+	_, _, err := UnmarshalFramed(nil)
+	assert.Error(t, err)
+	_, _, err = UnmarshalFramed([]byte("5 123\nk: v"))
+	assert.Error(t, err)
+
+	// padding is part of the record only if it's there
+	for _, s := range []string{"5 foo\nk: v\n", "6 foo\nk:+1\nv\n", "6 foo\nk:+1\nv", "6 foo\nk:+1\nv1 x\n"} {
+		rec, n, err := UnmarshalFramed([]byte(s))
+		assert.NoError(t, err, "s: '%s'", s)
+		assert.Equal(t, "foo", rec.Name)
+		v, _ := rec.Get("k")
+		assert.Equal(t, "v", v)
+		exp := len(s)
+		if strings.HasSuffix(s, " x\n") {
+			exp = 12
+		}
+		assert.Equal(t, exp, n, "s: '%s'", s)
+	}
+}
+
+func TestSplitBoundaries(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	positions := map[int64]bool{}
+	var currPos int64
+	for i := 0; i < 100; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		if i%7 == 0 {
+			rec.Write("large", largeValue)
+		}
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		positions[currPos] = true
+		currPos += int64(n)
+	}
+	d := buf.Bytes()
+	size := int64(len(d))
+
+	for _, n := range []int{1, 2, 3, 8, 1000} {
+		bounds, err := SplitBoundaries(bytes.NewReader(d), size, n)
+		assert.NoError(t, err)
+		assert.True(t, len(bounds) <= n)
+		assert.Equal(t, int64(0), bounds[0])
+		// read all records in chunks
+		nRecs := 0
+		for i, pos := range bounds {
+			assert.True(t, positions[pos])
+			end := size
+			if i < len(bounds)-1 {
+				end = bounds[i+1]
+				assert.True(t, end > pos)
+			}
+			var rec Record
+			for pos < end {
+				n, err := ReadRecordAt(bytes.NewReader(d), pos, &rec)
+				assert.NoError(t, err)
+				pos += int64(n)
+				nRecs++
+			}
+		}
+		assert.Equal(t, 100, nRecs)
+	}
+	bounds, err := SplitBoundaries(bytes.NewReader(d), size, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(bounds))
+
+	_, err = SplitBoundaries(bytes.NewReader(d[:100]), size, 4)
+	assert.Error(t, err)
+	_, err = SplitBoundaries(bytes.NewReader(d), size, 0)
+	assert.Error(t, err)
+
+	for _, n := range []int{1, 4} {
+		bounds, err = SplitBoundaries(bytes.NewReader(nil), 0, n)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{0}, bounds)
+	}
+
+	// records with values that are siser streams
+	var inner bytes.Buffer
+	wInner := NewWriter(&inner)
+	for i := 0; i < 100; i++ {
+		_, err = wInner.WriteString("k: v\n")
+		assert.NoError(t, err)
+	}
+	buf.Reset()
+	positions = map[int64]bool{}
+	currPos = 0
+	for i := 0; i < 4; i++ {
+		var rec Record
+		rec.Write("stream", inner.String())
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		positions[currPos] = true
+		currPos += int64(n)
+	}
+	d = buf.Bytes()
+	bounds, err = SplitBoundaries(bytes.NewReader(d), int64(len(d)), 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(bounds))
+	for _, pos := range bounds {
+		assert.True(t, positions[pos], "pos: %d", pos)
+	}
+}
+
+func TestReaderResetPos(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	_, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	_, err = w.WriteString("bar")
+	assert.NoError(t, err)
+
+	r := NewReaderBytes(buf.Bytes())
+	assert.True(t, r.ReadNextData())
+	assert.Equal(t, int64(6), r.NextRecordPos)
+	r.ResetPos(100)
+	assert.True(t, r.ReadNextData())
+	assert.Equal(t, int64(100), r.CurrRecordPos)
+	assert.Equal(t, int64(106), r.NextRecordPos)
+}
+
+func TestNewReaderGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	w := NewWriter(gw)
+	var rec Record
+	for i := 0; i < 3; i++ {
+		rec.Reset()
+		rec.Write("counter", strconv.Itoa(i))
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, gw.Close())
+
+	r, err := NewReaderGzip(&buf)
+	assert.NoError(t, err)
+	n := 0
+	for r.ReadNextRecord() {
+		v, _ := r.Record.Get("counter")
+		assert.Equal(t, strconv.Itoa(n), v)
+		n++
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, 3, n)
+
+	_, err = NewReaderGzip(bytes.NewBufferString("not gzip"))
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var positions []int64
+	var currPos int64
+	for i := 0; i < 5; i++ {
+		positions = append(positions, currPos)
+		n, err := w.Write([]byte(largeValue), time.Time{}, "")
+		assert.NoError(t, err)
+		currPos += int64(n)
+	}
+	d := buf.Bytes()
+
+	n, err, errOffset := Verify(bytes.NewReader(d))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, int64(-1), errOffset)
+
+	// truncated data
+	n, err, errOffset = Verify(bytes.NewReader(d[:positions[3]+20]))
+	assert.Error(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, positions[3], errOffset)
+
+	// truncated header
+	n, err, errOffset = Verify(bytes.NewReader(d[:positions[3]+2]))
+	assert.Error(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, positions[3], errOffset)
+
+	// corrupted header
+	d2 := append([]byte(nil), d...)
+	d2[positions[2]] = 'x'
+	n, err, errOffset = Verify(bytes.NewReader(d2))
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, positions[2], errOffset)
+}
+
+func TestReaderSkipN(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	for i := 0; i < 5; i++ {
+		rec.Reset()
+		rec.Write("counter", strconv.Itoa(i), "large", largeValue)
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	r := NewReaderBytes(d)
+	n, err := r.SkipN(3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.True(t, r.ReadNextRecord())
+	v, _ := r.Record.Get("counter")
+	assert.Equal(t, "3", v)
+	n, err = r.SkipN(3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.False(t, r.ReadNextRecord())
+
+	r = NewReaderBytes(d[:len(d)-20])
+	n, err = r.SkipN(10)
+	assert.Error(t, err)
+	assert.Equal(t, int64(4), n)
+}
+
+func TestReaderEOF(t *testing.T) {
+	d := []byte("3 123\nfoo\n")
+	r := NewReaderBytes(d)
+	assert.False(t, r.Done())
+	assert.False(t, r.EOF())
+	assert.True(t, r.ReadNextData())
+	assert.False(t, r.Done())
+	assert.False(t, r.EOF())
+	assert.False(t, r.ReadNextData())
+	assert.True(t, r.Done())
+	assert.True(t, r.EOF())
+	assert.NoError(t, r.Err())
+
+	r = NewReaderBytes(d[:7])
+	assert.False(t, r.ReadNextData())
+	assert.True(t, r.Done())
+	assert.False(t, r.EOF())
+	assert.Error(t, r.Err())
+}
+
+func TestReaderPadding(t *testing.T) {
+	tests := []struct {
+		s         string
+		positions []int64
+	}{
+		// padded, then EOF
+		{"3 foo\nabc\n", []int64{0, 10}},
+		// not padded, then EOF
+		{"3 foo\nabc", []int64{0, 9}},
+		// padded, then another record
+		{"3 foo\nabc\n2 bar\nde\n", []int64{0, 10, 19}},
+		// not padded, then another record
+		{"3 foo\nabc2 bar\nde", []int64{0, 9, 17}},
+		// data ending with newline is not padded
+		{"4 foo\nabc\n2 bar\nde\n", []int64{0, 10, 19}},
+	}
+	for _, test := range tests {
+		r := NewReaderBytes([]byte(test.s))
+		var positions []int64
+		for r.ReadNextData() {
+			positions = append(positions, r.CurrRecordPos)
+		}
+		assert.NoError(t, r.Err(), "s: '%s'", test.s)
+		assert.True(t, r.EOF())
+		positions = append(positions, r.NextRecordPos)
+		assert.Equal(t, test.positions, positions, "s: '%s'", test.s)
+		assert.Equal(t, int64(len(test.s)), r.NextRecordPos)
+	}
+
+	// what Writer writes
+	for _, noPadding := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.NoTimestamp = true
+		w.NoPadding = noPadding
+		for _, s := range []string{"abc", "abc\n", "", "de"} {
+			_, err := w.WriteStringNamed(s, "foo")
+			assert.NoError(t, err)
+		}
+		exp := []int64{0, 10, 20, 26}
+		if noPadding {
+			assert.Equal(t, "3 foo\nabc4 foo\nabc\n0 foo\n2 foo\nde", buf.String())
+			exp = []int64{0, 9, 19, 25}
+		}
+		r := NewReaderBytes(buf.Bytes())
+		r.Strict = true
+		var positions []int64
+		for r.ReadNextData() {
+			positions = append(positions, r.CurrRecordPos)
+		}
+		assert.NoError(t, r.Err())
+		assert.Equal(t, exp, positions)
+		assert.Equal(t, int64(buf.Len()), r.NextRecordPos)
+
+		// positions found with io.ReaderAt
+		d := buf.Bytes()
+		boundaries, err := SplitBoundaries(bytes.NewReader(d), int64(len(d)), len(d))
+		assert.NoError(t, err)
+		assert.Equal(t, exp, boundaries)
+		assert.Equal(t, exp, reversePositions(t, d))
+	}
+}
+
+func TestRecordWriteAfterUnmarshalBinary(t *testing.T) {
+	var rec Record
+	rec.Write("a", "1", "b", "2")
+	rec.Name = "rec"
+	d, err := rec.MarshalBinary()
+	assert.NoError(t, err)
+
+	var r2 Record
+	assert.NoError(t, r2.UnmarshalBinary(d))
+	r2.Write("c", "3")
+	d, err = r2.MarshalBinary()
+	assert.NoError(t, err)
+	var r3 Record
+	assert.NoError(t, r3.UnmarshalBinary(d))
+	assert.Equal(t, "rec", r3.Name)
+	assert.Equal(t, []Entry{{"a", "1"}, {"b", "2"}, {"c", "3"}}, r3.Entries)
+}
+
+func TestRecordWriteAfterUnmarshal(t *testing.T) {
+	rec, err := UnmarshalRecord([]byte("a: 1\n"), nil)
+	assert.NoError(t, err)
+	rec.Write("b", "2")
+	s := testRoundTrip(t, rec)
+	assert.Equal(t, "a: 1\nb: 2\n", s)
+}
+
+func TestReadOneRecord(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("k", "v", "long", largeValue)
+	rec.Name = "named"
+	n1, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Reset()
+	rec.Write("k", "ends with newline\n")
+	n2, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	buf.WriteString("raw")
+
+	var got Record
+	n, err := ReadOneRecord(&buf, &got, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, n1, n)
+	assert.Equal(t, "named", got.Name)
+	v, _ := got.Get("long")
+	assert.Equal(t, largeValue, v)
+	n, err = ReadOneRecord(&buf, &got, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, n2, n)
+	assert.Equal(t, rec.Entries, got.Entries)
+	// doesn't read past the record
+	assert.Equal(t, "raw", buf.String())
+
+	_, err = ReadOneRecord(&buf, &got, 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = ReadOneRecord(&buf, &got, 0)
+	assert.Equal(t, io.EOF, err)
+
+	invalid := []string{"3 foo\nab", "3 foo\nabc", "3 foo\nabcd", "x\n", "3 foo\nab\n\n"}
+	for _, s := range invalid {
+		_, err = ReadOneRecord(bytes.NewBufferString(s), &got, 0)
+		assert.Error(t, err, "s: '%s'", s)
+	}
+
+	// request / response over a connection
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		var req Record
+		_, err := ReadOneRecord(c2, &req, 0)
+		panicIfErr(err)
+		req.Write("resp", "ok")
+		_, err = NewWriter(c2).WriteRecord(&req)
+		panicIfErr(err)
+	}()
+	rec.Reset()
+	rec.Write("req", "1")
+	_, err = NewWriter(c1).WriteRecord(&rec)
+	assert.NoError(t, err)
+	_, err = ReadOneRecord(c1, &got, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{"req", "1"}, {"resp", "ok"}}, got.Entries)
+}
+
+func TestReaderNameBytes(t *testing.T) {
+	longName := strings.Repeat("long name ", 10)
+	names := []string{"httplog", "", "a%b=c\n", longName}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, name := range names {
+		_, err := w.WriteStringNamed("foo", name)
+		assert.NoError(t, err)
+	}
+	// header longer than buffer of bufio.Reader
+	r := NewReaderSize(&buf, 16)
+	for _, name := range names {
+		assert.True(t, r.ReadNextData())
+		assert.Equal(t, name, r.Name)
+		assert.Equal(t, name, string(r.NameBytes))
+		assert.Equal(t, "foo", string(r.Data))
+	}
+	assert.False(t, r.ReadNextData())
+	assert.NoError(t, r.Err())
+}
+
+func TestReaderHeaderAllocs(t *testing.T) {
+	// AllocsPerRun calls the function 11 times
+	const nRuns = 10
+	const perRun = 100
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < (nRuns+1)*perRun; i++ {
+		_, err := w.WriteStringNamed("foo", "http%log")
+		assert.NoError(t, err)
+	}
+	r := NewReaderBytes(buf.Bytes())
+	var skipped int64
+	allocs := testing.AllocsPerRun(nRuns, func() {
+		n, _ := r.SkipN(perRun)
+		skipped += n
+	})
+	assert.Equal(t, 0.0, allocs)
+	assert.NoError(t, r.Err())
+	assert.Equal(t, int64((nRuns+1)*perRun), skipped)
+	assert.Equal(t, "http%log", r.Name)
+}
+
+func TestWriterTagsAllocs(t *testing.T) {
+	w := NewWriter(ioutil.Discard)
+	w.NoTimestamp = true
+	var rec Record
+	rec.Write("k", "v")
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	noTagsAllocs := testing.AllocsPerRun(10, func() {
+		_, _ = w.WriteRecord(&rec)
+	})
+	// tags don't allocate
+	rec.Tags = []Entry{{"a key", "v=1"}, {"b", "2"}}
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = w.WriteRecord(&rec)
+	})
+	assert.Equal(t, noTagsAllocs, allocs)
+
+	var buf bytes.Buffer
+	w = NewWriter(&buf)
+	w.NoTimestamp = true
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "5 a%20key=v%3D1 b=2\nk: v\n", buf.String())
+}
+
+func TestMergeReaders(t *testing.T) {
+	// timestamps of records in each source
+	sources := [][]int64{
+		{1000, 3000, 5000, 5000},
+		{},
+		{2000, 3000, 6000},
+		{500},
+	}
+	var srcs []io.Reader
+	for i, times := range sources {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		for j, ms := range times {
+			var rec Record
+			rec.Write("src", strconv.Itoa(i), "n", strconv.Itoa(j))
+			rec.Name = "src" + strconv.Itoa(i)
+			rec.Tags = []Entry{{"n", strconv.Itoa(j)}}
+			rec.Timestamp = TimeFromUnixMillisecond(ms)
+			_, err := w.WriteRecord(&rec)
+			assert.NoError(t, err)
+		}
+		srcs = append(srcs, &buf)
+	}
+	var dst bytes.Buffer
+	assert.NoError(t, MergeReaders(&dst, srcs...))
+
+	exp := []string{"3 0", "0 0", "2 0", "0 1", "2 1", "0 2", "0 3", "2 2"}
+	var got []string
+	var prev time.Time
+	r := NewReaderBytes(dst.Bytes())
+	for r.ReadNextRecord() {
+		rec := r.Record
+		assert.False(t, rec.Timestamp.Before(prev))
+		prev = rec.Timestamp
+		src, _ := rec.Get("src")
+		n, _ := rec.Get("n")
+		assert.Equal(t, "src"+src, rec.Name)
+		tag, _ := r.Tag("n")
+		assert.Equal(t, n, tag)
+		got = append(got, src+" "+n)
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, exp, got)
+
+	assert.NoError(t, MergeReaders(&dst))
+	err := MergeReaders(&dst, bytes.NewBufferString("3 foo\nabc\n"), bytes.NewBufferString("x\n"))
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Delta = true
+	for i := 0; i < 2; i++ {
+		var rec Record
+		rec.Write("n", strconv.Itoa(i))
+		_, err = w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	assert.Error(t, MergeReaders(&dst, &buf))
+}
+
+func TestNameKey(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	w.NameKey = "type"
+	w.Delta = true
+	var recs []*Record
+	for i := 0; i < 3; i++ {
+		rec := &Record{}
+		rec.Write("n", strconv.Itoa(i))
+		if i != 1 {
+			rec.Name = "http"
+		}
+		_, err := w.WriteRecord(rec)
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	// records that have the type only in data
+	_, err := w.WriteString("type: old\nn: 3\n")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(buf.String(), "16 http\ntype: http\nn: 0\n"))
+	assert.Equal(t, []Entry{{"n", "0"}}, recs[0].Entries)
+
+	d := buf.Bytes()
+	r := NewReaderBytes(d)
+	r.NameKey = "type"
+	for i, rec := range recs {
+		assert.True(t, r.ReadNextRecord())
+		assert.Equal(t, rec.Entries, r.Record.Entries, "record %d", i)
+		assert.Equal(t, rec.Name, r.Record.Name)
+		assert.Equal(t, rec.Name, string(r.NameBytes))
+	}
+	assert.True(t, r.ReadNextRecord())
+	assert.Equal(t, "old", r.Record.Name)
+	assert.Equal(t, []Entry{{"n", "3"}}, r.Record.Entries)
+	assert.Equal(t, "n: 3\n", string(r.Record.Marshal()))
+	assert.False(t, r.ReadNextRecord())
+	assert.NoError(t, r.Err())
+
+	// without NameKey the entry is in the record
+	r = NewReaderBytes(d)
+	assert.True(t, r.ReadNextRecord())
+	assert.Equal(t, []Entry{{"type", "http"}, {"n", "0"}}, r.Record.Entries)
+}
+
+func TestEmptyRecord(t *testing.T) {
+	var empty Record
+	assert.Equal(t, 0, len(empty.Marshal()))
+	assert.Equal(t, 0, empty.MarshalSize())
+
+	tm := time.Unix(5, 0)
+	writers := []func(w *Writer){
+		func(w *Writer) {},
+		func(w *Writer) { w.NoTimestamp = true },
+		func(w *Writer) { w.Inline = true },
+		func(w *Writer) { w.NoPadding = true },
+		func(w *Writer) { w.Delta = true },
+	}
+	for i, setup := range writers {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		setup(w)
+		var positions []int64
+		var pos int64
+		for j, name := range []string{"", "marker", "", "marker"} {
+			rec := &Record{Name: name, Timestamp: tm}
+			if j == 2 {
+				rec.Write("k", "v")
+			}
+			n, err := w.WriteRecord(rec)
+			assert.NoError(t, err)
+			positions = append(positions, pos)
+			pos += int64(n)
+		}
+		if i == 0 {
+			assert.True(t, strings.HasPrefix(buf.String(), "0 5000\n0 5000 marker\n5 5000\nk: v\n0 5000 marker\n"))
+		}
+
+		d := buf.Bytes()
+		r := NewReaderBytes(d)
+		for j, name := range []string{"", "marker", "", "marker"} {
+			assert.True(t, r.ReadNextRecord(), "writer %d", i)
+			assert.Equal(t, positions[j], r.CurrRecordPos)
+			assert.Equal(t, name, r.Record.Name)
+			if !w.NoTimestamp {
+				assert.True(t, tm.Equal(r.Record.Timestamp))
+			}
+			if j == 2 {
+				assert.Equal(t, 1, len(r.Record.Entries))
+			} else {
+				assert.Equal(t, 0, len(r.Record.Entries))
+				if !w.Delta {
+					assert.Equal(t, 0, len(r.Data))
+				}
+			}
+		}
+		assert.False(t, r.ReadNextRecord())
+		assert.NoError(t, r.Err())
+		assert.Equal(t, int64(len(d)), r.NextRecordPos)
+
+		assert.Equal(t, positions, reversePositions(t, d))
+	}
+
+	empty.Name = "marker"
+	empty.Timestamp = tm
+	got, err := RoundTrip(&empty)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(got.Entries))
+	assert.Equal(t, "marker", got.Name)
+	assert.True(t, tm.Equal(got.Timestamp))
+
+	d, err := empty.MarshalBinary()
+	assert.NoError(t, err)
+	n, err := ReadOneRecord(bytes.NewReader(d), &empty, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, len(d), n)
+}
+
+func TestNewReaderSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("large", largeValue, "inline", strings.Repeat("x", 120))
+	rec.Name = strings.Repeat("n", 200)
+	for i := 0; i < 40; i++ {
+		rec.Tags = append(rec.Tags, Entry{"tag" + strconv.Itoa(i), "value"})
+	}
+	for i := 0; i < 3; i++ {
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+	for _, size := range []int{0, 16, 64, 4096} {
+		r := NewReaderSize(bytes.NewReader(d), size)
+		n := 0
+		for r.ReadNextRecord() {
+			assert.Equal(t, rec.Name, r.Record.Name)
+			assert.Equal(t, rec.Tags, r.Record.Tags)
+			assert.Equal(t, rec.Entries, r.Record.Entries)
+			n++
+		}
+		assert.NoError(t, r.Err())
+		assert.Equal(t, 3, n)
+	}
+}
+
+func TestReadTinyChunks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var recs []*Record
+	var positions []int64
+	var pos int64
+	for i := 0; i < 10; i++ {
+		w.NoPadding = i%3 == 1
+		w.Inline = i%4 == 2
+		rec := &Record{}
+		rec.Write("counter", strconv.Itoa(i))
+		if i%2 == 0 {
+			rec.Write("large", largeValue)
+		}
+		rec.Name = strings.Repeat("n", i*10)
+		rec.Tags = []Entry{{"i", strconv.Itoa(i)}}
+		n, err := w.WriteRecord(rec)
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+		positions = append(positions, pos)
+		pos += int64(n)
+	}
+	d := buf.Bytes()
+
+	readers := []func() io.Reader{
+		func() io.Reader { return iotest.OneByteReader(bytes.NewReader(d)) },
+		func() io.Reader { return iotest.HalfReader(bytes.NewReader(d)) },
+	}
+	for _, newReader := range readers {
+		r := NewReaderSize(newReader(), 16)
+		for i, rec := range recs {
+			assert.True(t, r.ReadNextRecord())
+			assert.Equal(t, positions[i], r.CurrRecordPos)
+			assert.Equal(t, rec.Entries, r.Record.Entries)
+			assert.Equal(t, rec.Name, r.Record.Name)
+			assert.Equal(t, rec.Tags, r.Record.Tags)
+		}
+		assert.False(t, r.ReadNextRecord())
+		assert.NoError(t, r.Err())
+		assert.Equal(t, int64(len(d)), r.NextRecordPos)
+
+		idx, err := BuildIndex(newReader())
+		assert.NoError(t, err)
+		assert.Equal(t, len(recs), len(idx.Names()))
+
+		nRecords, err, _ := Verify(newReader())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(recs)), nRecords)
+	}
+
+	// ReadOneRecord needs padding
+	buf.Reset()
+	w = NewWriter(&buf)
+	for _, rec := range recs {
+		_, err := w.WriteRecord(rec)
+		assert.NoError(t, err)
+	}
+	src := iotest.OneByteReader(&buf)
+	var got Record
+	for _, rec := range recs {
+		_, err := ReadOneRecord(src, &got, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, rec.Entries, got.Entries)
+	}
+	_, err := ReadOneRecord(src, &got, 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderReadNextNamed(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var positions []int64
+	var pos int64
+	for i := 0; i < 9; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		rec.Name = "rec" + strconv.Itoa(i%3)
+		if i%3 == 2 {
+			// would fail to decode
+			n, err := w.Write([]byte("invalid"), time.Time{}, rec.Name)
+			assert.NoError(t, err)
+			pos += int64(n)
+			continue
+		}
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		if i%3 == 1 {
+			positions = append(positions, pos)
+		}
+		pos += int64(n)
+	}
+	r := NewReaderBytes(buf.Bytes())
+	for i := 1; i < 9; i += 3 {
+		assert.True(t, r.ReadNextNamed("rec1"))
+		assert.Equal(t, "rec1", r.Record.Name)
+		v, _ := r.Record.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+		assert.Equal(t, positions[i/3], r.CurrRecordPos)
+	}
+	assert.False(t, r.ReadNextNamed("rec1"))
+	assert.NoError(t, r.Err())
+	assert.True(t, r.EOF())
+
+	r = NewReaderBytes(buf.Bytes())
+	assert.True(t, r.ReadNextNamed("rec1"))
+	assert.False(t, r.ReadNextRecord())
+	assert.Equal(t, "rec2", r.Name)
+	assert.Error(t, r.Err())
+
+	// deltas of records with the same name
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.Delta = true
+	for i := 0; i < 3; i++ {
+		var rec Record
+		rec.Write("k", "v", "counter", strconv.Itoa(i))
+		rec.Name = "rec"
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	r = NewReaderBytes(buf.Bytes())
+	for i := 0; i < 3; i++ {
+		assert.True(t, r.ReadNextNamed("rec"))
+		assert.Equal(t, []Entry{{"k", "v"}, {"counter", strconv.Itoa(i)}}, r.Record.Entries)
+	}
+	assert.False(t, r.ReadNextNamed("rec"))
+	assert.NoError(t, r.Err())
+}
+
+func TestWriteTrailer(t *testing.T) {
+	for _, magic := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Checksum = true
+		if magic {
+			_, err := w.WriteMagic()
+			assert.NoError(t, err)
+		}
+		for i := 0; i < 5; i++ {
+			w.NoPadding = i == 3
+			var rec Record
+			rec.Write("counter", strconv.Itoa(i), "large", largeValue)
+			_, err := w.WriteRecord(&rec)
+			assert.NoError(t, err)
+		}
+		_, err := w.WriteString("k: v\n")
+		assert.NoError(t, err)
+		assert.Error(t, VerifyTrailer(bytes.NewReader(buf.Bytes())))
+		size := buf.Len()
+		_, err = w.WriteTrailer()
+		assert.NoError(t, err)
+
+		d := buf.Bytes()
+		assert.NoError(t, VerifyTrailer(bytes.NewReader(d)))
+		assert.NoError(t, VerifyTrailer(iotest.OneByteReader(bytes.NewReader(d))))
+
+		// regular reader
+		r := NewReaderBytes(d)
+		assert.NoError(t, r.AutoDetect())
+		n := 0
+		for r.ReadNextRecord() {
+			n++
+			if n < 7 {
+				assert.False(t, r.IsTrailer())
+			}
+		}
+		assert.NoError(t, r.Err())
+		assert.Equal(t, 7, n)
+		assert.True(t, r.IsTrailer())
+		v, _ := r.Record.Get("size")
+		assert.Equal(t, strconv.Itoa(size), v)
+
+		// corrupted
+		d2 := append([]byte(nil), d...)
+		idx := bytes.Index(d2, []byte("counter: 2"))
+		d2[idx+9] = '7'
+		assert.Error(t, VerifyTrailer(bytes.NewReader(d2)))
+
+		d2 = append(append([]byte(nil), d...), []byte("3 foo\nabc\n")...)
+		assert.Error(t, VerifyTrailer(bytes.NewReader(d2)))
+	}
+
+	// checksum must be enabled before the first write
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_, err := w.WriteTrailer()
+	assert.Error(t, err)
+	_, err = w.WriteString("abc")
+	assert.NoError(t, err)
+	w.Checksum = true
+	_, err = w.WriteTrailer()
+	assert.Error(t, err)
+
+	size := buf.Len()
+	w = NewWriter(&buf)
+	w.Checksum = true
+	w.JSONL = true
+	_, err = w.WriteTrailer()
+	assert.Error(t, err)
+	assert.Equal(t, size, buf.Len())
+}
+
+func TestReaderOffsets(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var positions []int64
+	var names []string
+	var pos int64
+	for i := 0; i < 5; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i), "large", largeValue)
+		rec.Name = "rec" + strconv.Itoa(i)
+		n, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		names = append(names, rec.Name)
+		pos += int64(n)
+	}
+	d := buf.Bytes()
+
+	r := NewReaderBytes(d)
+	var gotPositions []int64
+	var gotNames []string
+	r.Offsets(func(pos int64, name string) bool {
+		gotPositions = append(gotPositions, pos)
+		gotNames = append(gotNames, name)
+		return true
+	})
+	assert.NoError(t, r.Err())
+	assert.True(t, r.EOF())
+	assert.Equal(t, positions, gotPositions)
+	assert.Equal(t, names, gotNames)
+
+	var rec Record
+	_, err := ReadRecordAt(bytes.NewReader(d), gotPositions[3], &rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "rec3", rec.Name)
+
+	// stop early and continue reading
+	r = NewReaderBytes(d)
+	n := 0
+	r.Offsets(func(pos int64, name string) bool {
+		n++
+		return n < 2
+	})
+	assert.Equal(t, 2, n)
+	assert.True(t, r.ReadNextRecord())
+	assert.Equal(t, "rec2", r.Record.Name)
+
+	r = NewReaderBytes(d[:len(d)-100])
+	r.Offsets(func(pos int64, name string) bool {
+		return true
+	})
+	assert.Error(t, r.Err())
+}
+
+func TestWriteRecordBytes(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Write("uri", "/foo", "large", largeValue)
+	rec.Name = "httplog"
+	d, n, err := w.WriteRecordBytes(&rec)
+	assert.NoError(t, err)
+	assert.Equal(t, len(d), n)
+	assert.Equal(t, buf.Bytes(), d)
+
+	// the returned bytes are not over-written by the next write
+	exp := append([]byte(nil), d...)
+	rec.Reset()
+	rec.Write("uri", "/bar")
+	d2, n2, err := w.WriteRecordBytes(&rec)
+	assert.NoError(t, err)
+	assert.Equal(t, exp, d)
+	assert.Equal(t, buf.Bytes()[n:], d2)
+	assert.Equal(t, len(d2), n2)
+
+	r := NewReaderBytes(d)
+	ok := r.ReadNextRecord()
+	assert.True(t, ok)
+	v, _ := r.Record.Get("uri")
+	assert.Equal(t, "/foo", v)
+	assert.Equal(t, "httplog", r.Name)
+
+	// nothing is returned on error
+	w = NewWriter(&failingWriter{})
+	d, n, err = w.WriteRecordBytes(&rec)
+	assert.Error(t, err)
+	assert.Nil(t, d)
+	assert.Equal(t, 0, n)
+}
+
+func TestParseHeader(t *testing.T) {
+	ts := TimeFromUnixMillisecond(1553488435903)
+	tests := []struct {
+		line string
+		size int64
+		ts   time.Time
+		name string
+	}{
+		{"5\n", 5, time.Time{}, ""},
+		{"5", 5, time.Time{}, ""},
+		{"0 1553488435903\n", 0, ts, ""},
+		{"12 1553488435903 httplog\n", 12, ts, "httplog"},
+		{"12 1553488435903 http log", 12, ts, "http log"},
+		{"12 httplog\n", 12, time.Time{}, "httplog"},
+		{"12 1553488435903 httplog k=v\n", 12, ts, "httplog"},
+		{"12 1553488435903 a%0Ab\n", 12, ts, "a\nb"},
+	}
+	for _, test := range tests {
+		size, gotTs, name, err := ParseHeader([]byte(test.line))
+		assert.NoError(t, err, "line: '%s'", test.line)
+		assert.Equal(t, test.size, size, "line: '%s'", test.line)
+		assert.True(t, test.ts.Equal(gotTs), "line: '%s'", test.line)
+		assert.Equal(t, test.name, name, "line: '%s'", test.line)
+	}
+
+	invalid := []string{
+		"",
+		"\n",
+		"-5\n",
+		"abc 1553488435903\n",
+		"99999999999999999999 1553488435903\n",
+		"5 99999999999999999999\n",
+	}
+	for _, line := range invalid {
+		_, _, _, err := ParseHeader([]byte(line))
+		assert.Error(t, err, "line: '%s'", line)
+	}
+}
+
+func TestReaderStrictEOF(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	var rec Record
+	rec.Write("k", "v")
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	d := buf.Bytes()
+
+	readAll := func(d []byte, strictEOF bool) (int, error) {
+		r := NewReaderBytes(d)
+		r.StrictEOF = strictEOF
+		n := 0
+		for r.ReadNextRecord() {
+			n++
+		}
+		return n, r.Err()
+	}
+
+	// clean end of stream is never an error
+	for _, strictEOF := range []bool{false, true} {
+		n, err := readAll(d, strictEOF)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	// partial header
+	partial := append(append([]byte(nil), d...), "12"...)
+	n, err := readAll(partial, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = readAll(partial, true)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, n)
+
+	// partial data
+	for _, truncated := range [][]byte{d[:len(d)-2], d[:2]} {
+		for _, strictEOF := range []bool{false, true} {
+			_, err = readAll(truncated, strictEOF)
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestWriterJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.JSONL = true
+	var rec Record
+	rec.Write("url", "/\"foo\"", "code", "200", "multi", "a\nb", "code", "404")
+	rec.Name = "httplog"
+	rec.Timestamp = TimeFromUnixMillisecond(1553488435903)
+	rec.Tags = []Entry{{"level", "info"}, {"level", "debug"}}
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Reset()
+	w.NoTimestamp = true
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Write("k", "v")
+	d, _, err := w.WriteRecordBytes(&rec)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"k\":\"v\"}\n", string(d))
+
+	exp := `{"_name":"httplog","_timestamp":1553488435903,"_tags":{"level":"info","level":"debug"},"url":"/\"foo\"","code":"200","multi":"a\nb","code":"404"}
+{}
+{"k":"v"}
+`
+	assert.Equal(t, exp, buf.String())
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+	}
+
+	// keys of metadata can't be used as keys of entries
+	for _, key := range []string{"_name", "_timestamp", "_tags"} {
+		rec.Reset()
+		rec.Write("a", "1", key, "x")
+		n, err := w.WriteRecord(&rec)
+		assert.Error(t, err)
+		assert.Equal(t, 0, n)
+	}
+	assert.Equal(t, exp, buf.String())
+}
+
+func TestReaderReadBatch(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < 5; i++ {
+		var rec Record
+		rec.Write("counter", strconv.Itoa(i))
+		_, err := w.WriteRecord(&rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	r := NewReaderBytes(d)
+	dst := make([]*Record, 3)
+	var counters []string
+	var sizes []int
+	for {
+		n, err := r.ReadBatch(2, dst)
+		assert.NoError(t, err)
+		if n == 0 {
+			break
+		}
+		sizes = append(sizes, n)
+		for _, rec := range dst[:n] {
+			v, _ := rec.Get("counter")
+			counters = append(counters, v)
+		}
+	}
+	assert.Equal(t, []int{2, 2, 1}, sizes)
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, counters)
+	// dst is filled up to n
+	assert.Nil(t, dst[2])
+
+	// n is limited by len(dst)
+	r = NewReaderBytes(d)
+	n, err := r.ReadBatch(10, dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	r = NewReaderBytes([]byte("5\nk: v\n3\nabc"))
+	n, err = r.ReadBatch(2, dst)
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestVersion(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.NoTimestamp = true
+	var rec Record
+	rec.Write("k", "v")
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	w.Version = 2
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Name = "named"
+	rec.Tags = []Entry{{"t", "1"}}
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	w.Version = 3
+	_, err = w.WriteString("k: v\n")
+	assert.NoError(t, err)
+	exp := "5\nk: v\n5 siser.version=2\nk: v\n5 named t=1 siser.version=2\nk: v\n5 siser.version=3\nk: v\n"
+	assert.Equal(t, exp, buf.String())
+
+	r := NewReaderBytes(buf.Bytes())
+	var versions []int
+	var tags [][]Entry
+	for r.ReadNextRecord() {
+		versions = append(versions, r.Version)
+		tags = append(tags, append([]Entry(nil), r.Record.Tags...))
+		if r.Version >= 2 {
+			v, ok := r.Tag(versionTag)
+			assert.True(t, ok)
+			assert.Equal(t, strconv.Itoa(r.Version), v)
+		}
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, []int{0, 2, 2, 3}, versions)
+	// version is not a tag of the record
+	assert.Empty(t, tags[1])
+	assert.Equal(t, []Entry{{"t", "1"}}, tags[2])
+
+	for _, s := range []string{"5 siser.version=x\nk: v\n", "5 siser.version=-1\nk: v\n"} {
+		r = NewReaderBytes([]byte(s))
+		assert.True(t, r.ReadNextRecord())
+		assert.Equal(t, 0, r.Version)
+		assert.Empty(t, r.Record.Tags)
+		v, _ := r.Record.Get("k")
+		assert.Equal(t, "v", v)
+
+		r = NewReaderBytes([]byte(s))
+		r.Strict = true
+		assert.False(t, r.ReadNextData())
+		assert.Error(t, r.Err())
+	}
+}
+
+func TestReaderBuffered(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_, err := w.WriteString("foo")
+	assert.NoError(t, err)
+	_, err = w.WriteString("bar\n")
+	assert.NoError(t, err)
+	nRecords := buf.Len()
+	raw := "raw data after records"
+	buf.WriteString(raw)
+	d := buf.Bytes()
+
+	src := bytes.NewReader(d)
+	br := bufio.NewReader(src)
+	r := NewReader(br)
+	assert.Equal(t, 0, r.Buffered())
+	for i := 0; i < 2; i++ {
+		assert.True(t, r.ReadNextData())
+		pos := int64(len(d)) - int64(src.Len())
+		assert.Equal(t, pos, r.NextRecordPos+int64(r.Buffered()))
+	}
+	assert.Equal(t, int64(nRecords), r.NextRecordPos)
+	rest, err := ioutil.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, string(rest))
+	assert.Equal(t, 0, r.Buffered())
+}
+
+func TestReaderAutoDetect(t *testing.T) {
+	for _, noTimestamp := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.NoTimestamp = noTimestamp
+		nMagic, err := w.WriteMagic()
+		assert.NoError(t, err)
+		// name that looks like a timestamp
+		_, err = w.WriteStringNamed("foo", "1234")
+		assert.NoError(t, err)
+
+		r := NewReaderBytes(buf.Bytes())
+		assert.NoError(t, r.AutoDetect())
+		assert.Equal(t, noTimestamp, r.NoTimestamp)
+		assert.Equal(t, int64(nMagic), r.NextRecordPos)
+		assert.True(t, r.ReadNextData())
+		assert.Equal(t, "1234", r.Name)
+		assert.Equal(t, int64(nMagic), r.CurrRecordPos)
+		assert.Equal(t, int64(buf.Len()), r.NextRecordPos)
+		assert.False(t, r.ReadNextData())
+		assert.True(t, r.EOF())
+	}
+
+	// data without magic line
+	for _, s := range []string{"", "3 foo\nabc\n"} {
+		r := NewReaderBytes([]byte(s))
+		assert.NoError(t, r.AutoDetect())
+		assert.Equal(t, int64(0), r.NextRecordPos)
+		for r.ReadNextData() {
+		}
+		assert.True(t, r.EOF())
+	}
+
+	invalid := []string{"#siser v2\n", "#siser v1 compressed\n", "#siser v1"}
+	for _, s := range invalid {
+		r := NewReaderBytes([]byte(s))
+		assert.Error(t, r.AutoDetect(), "s: '%s'", s)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var prev, curr Record
+	prev.Write("uri", "/", "code", "200", "ua", "curl")
+	curr.Write("uri", "/atom.xml", "code", "200", "size", "5")
+	delta, ok := Diff(&prev, &curr)
+	assert.True(t, ok)
+	assert.Equal(t, "-ua:+0\n=uri: /atom.xml\n=size: 5\n", string(delta.Marshal()))
+	got, err := ApplyDelta(&prev, delta)
+	assert.NoError(t, err)
+	assert.Equal(t, curr.Entries, got.Entries)
+
+	delta, ok = Diff(&prev, &prev)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(delta.Entries))
+
+	// can't re-create different order or duplicate keys
+	var r Record
+	r.Write("code", "200", "uri", "/")
+	_, ok = Diff(&prev, &r)
+	assert.False(t, ok)
+	r.Reset()
+	r.Write("uri", "/", "uri", "/2")
+	_, ok = Diff(&prev, &r)
+	assert.False(t, ok)
+
+	r.Reset()
+	r.Write("uri", "/")
+	_, err = ApplyDelta(&prev, &r)
+	assert.Error(t, err)
+}
+
+func TestWriterDelta(t *testing.T) {
+	var recs []*Record
+	for i := 0; i < 8; i++ {
+		r := &Record{}
+		if i == 5 {
+			// different order, written in full
+			r.Write("code", "200", "uri", "/atom.xml")
+		} else {
+			r.Write("uri", "/atom.xml", "code", "200")
+		}
+		r.Write("ip", "54.186.248.49", "counter", strconv.Itoa(i))
+		if i%3 == 0 {
+			r.Write("extra", "x")
+		}
+		r.Name = "httplog"
+		r.Tags = []Entry{{"level", "info"}}
+		recs = append(recs, r)
+	}
+
+	var buf, bufFull bytes.Buffer
+	w := NewWriter(&buf)
+	w.Delta = true
+	wFull := NewWriter(&bufFull)
+	tm := time.Unix(5, 0)
+	for i, r := range recs {
+		_, err := w.WriteRecordTime(r, tm)
+		assert.NoError(t, err)
+		_, err = wFull.WriteRecordTime(r, tm)
+		assert.NoError(t, err)
+		if i == 6 {
+			// breaks the chain of deltas
+			_, err = w.Write([]byte("raw: data\n"), tm, "raw")
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []Entry{{"level", "info"}}, recs[1].Tags)
+	assert.True(t, buf.Len() < bufFull.Len())
+	assert.Contains(t, buf.String(), "=counter: 2\n")
+	// written in full after raw data
+	assert.Contains(t, buf.String(), "\ncounter: 7\n")
+
+	r := NewReaderBytes(buf.Bytes())
+	var got []*Record
+	for r.ReadNextRecord() {
+		if r.Name != "raw" {
+			got = append(got, r.Record.Clone())
+		}
+	}
+	assert.NoError(t, r.Err())
+	assert.Equal(t, len(recs), len(got))
+	for i, rec := range got {
+		assert.Equal(t, recs[i].Entries, rec.Entries)
+		assert.Equal(t, recs[i].Tags, rec.Tags)
+		assert.Equal(t, "httplog", rec.Name)
+	}
+
+	// a delta can't be read without the previous record
+	r = NewReaderBytes(buf.Bytes())
+	_, err := r.SkipN(1)
+	assert.NoError(t, err)
+	assert.False(t, r.ReadNextRecord())
+	assert.Error(t, r.Err())
+	var rec Record
+	_, err = ReadRecordAt(bytes.NewReader(buf.Bytes()), r.CurrRecordPos, &rec)
+	assert.Error(t, err)
+	rr, err := NewReverseReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	// records at the end are written in full, record 4 is a delta
+	for err == nil {
+		_, err = rr.ReadPrev()
+	}
+	assert.Contains(t, err.Error(), "no previous record for a delta")
+}
+
+func TestWritePanics(t *testing.T) {
+	rec := &Record{}
+	assert.Panics(t, func() { rec.Write("foo") }, "should panic with even number of arguments")
+}
+
+func TestRecordWriteKV(t *testing.T) {
+	var r Record
+	assert.NoError(t, r.WriteKV("a", "1", "b", "2"))
+	assert.NoError(t, r.WriteKV())
+	assert.Error(t, r.WriteKV("c"))
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 1\nb: 2\n", s)
+}
+
+func TestRecordValidate(t *testing.T) {
+	var r Record
+	assert.NoError(t, r.Validate())
+	r.Write("a", "1\n:x", "", "empty", "zażółć", "", "tab\t", "v")
+	r.Name = "a\nb"
+	r.Tags = []Entry{{"k\n", "v="}}
+	assert.NoError(t, r.Validate())
+	got, err := RoundTrip(&r)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Entries, got.Entries)
+
+	for _, key := range []string{"a:b", "a\nb", ":"} {
+		r.Reset()
+		r.Write("a", "1", key, "v")
+		assert.Error(t, r.Validate(), "key: '%s'", key)
+		got, err = RoundTrip(&r)
+		assert.True(t, err != nil || !assert.ObjectsAreEqual(r.Entries, got.Entries))
+	}
+}
+
+func TestRecordWriteIf(t *testing.T) {
+	var r Record
+	r.WriteIf(true, "a", "1")
+	r.WriteIf(false, "b", "2")
+	r.WriteNonEmpty("trace", "")
+	r.WriteNonEmpty("c", "3")
+	r.WriteIf(true, "empty", "")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 1\nc: 3\nempty:+0\n", s)
+}
+
+func TestRecordWith(t *testing.T) {
+	r := (&Record{}).With("a", "1").With("b", "2")
+	assert.Equal(t, []Entry{{"a", "1"}, {"b", "2"}}, r.Entries)
+	s := testRoundTrip(t, r)
+	assert.Equal(t, "a: 1\nb: 2\n", s)
+}
+
+func TestRecordWriteEntries(t *testing.T) {
+	var r Record
+	r.WriteEntries()
+	r.Write("a", "1")
+	r.WriteEntries(Entry{"b", "2"}, Entry{"long", largeValue})
+	var r2 Record
+	r2.WriteEntries(r.Entries...)
+	assert.Equal(t, r.Entries, r2.Entries)
+	assert.Equal(t, r.Marshal(), r2.Marshal())
+	testRoundTrip(t, &r2)
+}
+
+func TestRecordWriteChecked(t *testing.T) {
+	var r Record
+	assert.NoError(t, r.WriteChecked("a", "1", " ", "space key", "b", "with\nnewline"))
+	invalid := []string{"", "a:b", "a\nb", "zażółć", "tab\t", "\x7f"}
+	for _, key := range invalid {
+		assert.Error(t, r.WriteChecked("c", "2", key, "v"), "key: '%s'", key)
+	}
+	assert.Error(t, r.WriteChecked("c"))
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, "a: 1\n : space key\nb:+12\nwith\nnewline\n", s)
+}
+
+func TestRecordEmptyKey(t *testing.T) {
+	// Write allows empty key and it's distinct from whitespace-only key
+	var r Record
+	r.Write("", ": starts with colon", " ", "space", "", "")
+	s := testRoundTrip(t, &r)
+	assert.Equal(t, ": : starts with colon\n : space\n:+0\n", s)
+	v, ok := r.Get("")
+	assert.True(t, ok)
+	assert.Equal(t, ": starts with colon", v)
+	v, ok = r.Get(" ")
+	assert.True(t, ok)
+	assert.Equal(t, "space", v)
+
+	// a line starting with ':' is an entry with empty key
+	rec, err := UnmarshalRecordStrict([]byte(": something\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{"", "something"}}, rec.Entries)
+	_, err = UnmarshalRecord([]byte(":something\n"), nil)
+	assert.Error(t, err)
+}
+
+func TestIntStrLen(t *testing.T) {
 	numbers := []int{-1, 0, 1}
 	n1 := 1
 	n2 := -1
@@ -394,6 +3365,12 @@ func TestIntStrLen(t *testing.T) {
 		exp := len(strconv.Itoa(n))
 		assert.Equal(t, exp, got)
 	}
+	numbers64 := []int64{math.MinInt64, math.MinInt64 + 1, math.MaxInt64, -10, 10}
+	for _, n := range numbers64 {
+		got := intStrLen64(n)
+		exp := len(strconv.FormatInt(n, 10))
+		assert.Equal(t, exp, got)
+	}
 }
 
 func TestCrashes(t *testing.T) {
@@ -408,6 +3385,19 @@ func TestCrashes(t *testing.T) {
 	}
 }
 
+func TestReadTimestampOutOfRange(t *testing.T) {
+	headers := []string{
+		"3 9223372036854775807\nfoo\n",
+		"3 -9223372036854775807\nfoo\n",
+	}
+	for _, s := range headers {
+		r := NewReader(bufio.NewReader(bytes.NewBufferString(s)))
+		ok := r.ReadNextData()
+		assert.False(t, ok)
+		assert.Error(t, r.Err(), "s: '%s'", s)
+	}
+}
+
 var rec Record
 var globalData []byte
 
@@ -459,6 +3449,29 @@ func BenchmarkSiserMarshal2(b *testing.B) {
 	}
 }
 
+// BenchmarkSiserMarshalEntries measures Marshal of a record filled
+// by Unmarshal, which is re-created from Entries
+func BenchmarkSiserMarshalEntries(b *testing.B) {
+	rec, err := UnmarshalRecord(serializedSiser, nil)
+	panicIfErr(err)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		rec.buf = rec.buf[:0]
+		// assign to global to prevents optimizing the loop
+		globalData = rec.Marshal()
+	}
+}
+
+func BenchmarkWriterWrite(b *testing.B) {
+	w := NewWriter(ioutil.Discard)
+	tm := time.Now()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, err := w.Write(serializedSiser, tm, "httplog")
+		panicIfErr(err)
+	}
+}
+
 func BenchmarkJSONMarshal(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		rec := testRecJSON{
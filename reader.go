@@ -3,9 +3,13 @@ package siser
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,155 +19,584 @@ type Reader struct {
 
 	// hints that the data was written without a timestamp
 	// (see Writer.NoTimestamp). We're permissive i.e. we'll
-	// read timestamp if it's written even if NoTimestamp is true
+	// read timestamp if it's written even if NoTimestamp is true.
+	// Without the hint we detect headers without timestamp. Writer
+	// escapes names that start with a number, so the hint is only
+	// needed for names that look like a number written by other writers
 	NoTimestamp bool
 
+	// MaxRecordSize, if > 0, is the maximum size of data in a record.
+	// Records declaring bigger size are rejected with an error, which
+	// protects from allocating huge buffers when reading untrusted data
+	MaxRecordSize int64
+
+	// MaxRecordEntries, if > 0, is the maximum number of entries
+	// decoded from a record by ReadNextRecord. Records with more
+	// entries are rejected with an error
+	MaxRecordEntries int
+
+	// MaxBufferReuse is the maximum size of Data buffer that we re-use
+	// between records. Bigger buffers are freed, so that we don't hold
+	// on to memory after reading a large record. 0 means we never free it,
+	// which is faster if all records are large but uses more memory.
+	// -1 means we always allocate a new buffer.
+	// NewReader sets it to DefaultMaxBufferReuse
+	MaxBufferReuse int64
+
+	// Strict makes the reader reject headers that are not exactly in the
+	// format written by Writer (e.g. with extra spaces or unknown fields)
+	// and decode records with UnmarshalRecordStrict.
+	// By default we're lenient, for forward compatibility
+	Strict bool
+
+	// NameKey, if set, makes ReadNextRecord use the value of the first
+	// entry, if it has this key, as the name of the record, if it has no
+	// name in the header. The entry is removed from the record.
+	// It reads records written with Writer.NameKey and records that
+	// have the type in the data instead of the header
+	NameKey string
+
+	// StrictEOF makes Err() return io.ErrUnexpectedEOF if the stream
+	// ends with a partial header. By default it's treated like the end
+	// of the stream e.g. a record that was being written when the file
+	// was read. A stream ending in the middle of data is always an error
+	StrictEOF bool
+
 	// Record is available after ReadNextRecord().
 	// It's over-written in next ReadNextRecord().
 	Record *Record
 
-	// Data / Name / Timestampe are available after ReadNextData.
+	// Data / Name / Timestampe / Tags are available after ReadNextData.
 	// They are over-written in next ReadNextData.
 	Data      []byte
 	Name      string
 	Timestamp time.Time
+	Tags      []Entry
+	// NameBytes is the same as Name, for comparing without allocating.
+	// It's over-written in next ReadNextData
+	NameBytes []byte
+	// Version is the schema version written with Writer.Version,
+	// 0 if it wasn't written or is invalid (which is an error in Strict
+	// mode). It's over-written in next ReadNextData
+	Version int
 
 	// position of the current record within the reader.
 	// We keep track of it so that callers can index records
 	// by offset and seek to it
 	CurrRecordPos int64
 
-	// position of the next record within the reader.
+	// position of the next record within the reader, which is
+	// also the end of the current record. The current record
+	// spans [CurrRecordPos, NextRecordPos)
 	NextRecordPos int64
 
+	// size of data declared in the last header
+	dataLen int
+	// size of the last header
+	hdrLen int
+
+	// if not nil, all data read is written to it (see VerifyTrailer)
+	hash hash.Hash32
+
 	err error
 
 	// true if reached end of file with io.EOF
 	done bool
+
+	// entries of the last record, if it was read with ReadNextRecord,
+	// for applying a delta (see Writer.Delta)
+	prevEntries []Entry
+	hasPrev     bool
 }
 
+// DefaultMaxBufferReuse is the default value of Reader.MaxBufferReuse
+const DefaultMaxBufferReuse = 1024 * 1024
+
 // NewReader creates a new reader
 func NewReader(r *bufio.Reader) *Reader {
 	return &Reader{
-		r:      r,
-		Record: &Record{},
+		r:              r,
+		Record:         &Record{},
+		MaxBufferReuse: DefaultMaxBufferReuse,
+	}
+}
+
+// NewReaderSize creates a new reader for reading records from r, with
+// a buffer of at least bufSize bytes. There's no minimum size: a header
+// longer than the buffer is read correctly, but it has to be copied.
+// Use a bigger buffer if most headers are long (e.g. with many tags)
+func NewReaderSize(r io.Reader, bufSize int) *Reader {
+	return NewReader(bufio.NewReaderSize(r, bufSize))
+}
+
+// NewReaderBytes creates a new reader for reading records from d.
+// For random access to records in d use ReadRecordAt(bytes.NewReader(d), ...)
+func NewReaderBytes(d []byte) *Reader {
+	return NewReader(bufio.NewReader(bytes.NewReader(d)))
+}
+
+// NewReaderGzip creates a new reader for reading records from
+// gzip-compressed data, like a rotated log file compressed with gzip.
+// Note: CurrRecordPos and NextRecordPos are positions in uncompressed data
+// so they can't be used for seeking in r
+func NewReaderGzip(r io.Reader) (*Reader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
 	}
+	return NewReader(bufio.NewReader(gr)), nil
 }
 
-// Done returns true if we're finished reading from the reader
+// Done returns true if we're finished reading from the reader,
+// either because we reached the end of data or because of an error.
+// Use EOF() or Err() to tell them apart
 func (r *Reader) Done() bool {
 	return r.err != nil || r.done
 }
 
+// EOF returns true if we've read all records without errors
+func (r *Reader) EOF() bool {
+	return r.err == nil && r.done
+}
+
 // ReadNextData reads next block from the reader, returns false
 // when no more record. If returns false, check Err() to see
-// if there were errors.
+// if there were errors. At the end of data, EOF() is true and Err()
+// is nil (we don't report io.EOF as an error).
 // After reading Data containst data, and Timestamp and (optional) Name
 // contain meta-data
 func (r *Reader) ReadNextData() bool {
+	return r.readNext(false)
+}
+
+// readNext reads next record. If skipData is true, only the header
+// is parsed and data is skipped, leaving Data empty
+func (r *Reader) readNext(skipData bool) bool {
+	return r.readHeader() && r.readData(skipData)
+}
+
+// readHeader reads and parses the header of the next record
+func (r *Reader) readHeader() bool {
 	if r.Done() {
 		return false
 	}
-	r.Name = ""
+	r.hasPrev = false
+	r.Timestamp = time.Time{}
 	r.CurrRecordPos = r.NextRecordPos
+	// Name is not reset here, so that parseHeader doesn't allocate it
+	// if it's the same as in the previous record
 
 	// read header in the format:
 	// "${size} ${timestamp_in_unix_epoch_ms} ${name}\n"
-	// or (if NoTimestamp):
+	// or (if written with Writer.NoTimestamp):
 	// "${size} ${name}\n"
 	// ${name} is optional
-	hdr, err := r.r.ReadBytes('\n')
+	// ReadSlice doesn't allocate. hdr is only valid until next read
+	hdr, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// header longer than the buffer
+		var rest []byte
+		hdr = append([]byte(nil), hdr...)
+		rest, err = r.r.ReadBytes('\n')
+		hdr = append(hdr, rest...)
+	}
 	if err != nil {
+		if err == io.EOF && len(hdr) > 0 && r.StrictEOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err == io.EOF {
 			r.done = true
 		} else {
 			r.err = err
 		}
+		r.resetName()
 		return false
 	}
-	recSize := len(hdr)
+	r.hdrLen = len(hdr)
+	if r.hash != nil {
+		_, _ = r.hash.Write(hdr)
+	}
+	_, err = r.parseHeader(hdr)
+	if err != nil {
+		r.err = err
+		r.resetName()
+		return false
+	}
+	return true
+}
+
+func (r *Reader) resetName() {
+	r.Name = ""
+	r.NameBytes = r.NameBytes[:0]
+}
+
+// readData reads (or skips) data of the record whose header was
+// read with readHeader
+func (r *Reader) readData(skipData bool) bool {
+	recSize := r.hdrLen
+	size := int64(r.dataLen)
+	var err error
+	var lastByte byte
+	if skipData {
+		r.Data = r.Data[:0]
+		if size > 0 {
+			// we need last byte to know if data was padded with '\n'
+			_, err = r.r.Discard(int(size - 1))
+			if err == nil {
+				lastByte, err = r.r.ReadByte()
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				r.err = err
+				return false
+			}
+		}
+	} else {
+		// we try to re-use r.Data as long as it doesn't grow too much
+		maxReuse := r.MaxBufferReuse
+		if maxReuse < 0 || (maxReuse > 0 && int64(cap(r.Data)) > maxReuse) {
+			r.Data = nil
+		}
+		r.Data, err = readN(r.r, r.Data, size)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			return false
+		}
+		n := len(r.Data)
+		if r.hash != nil {
+			_, _ = r.hash.Write(r.Data)
+		}
+		if n > 0 {
+			lastByte = r.Data[n-1]
+		}
+	}
+	recSize += int(size)
+
+	// account for the fact that for readability we might
+	// have padded data with '\n'
+	// same as needsNewline logic in Writer.Write
+	// We only consume it if it's there, because it's not written
+	// with Writer.NoPadding
+	needsNewline := (size > 0) && (lastByte != '\n')
+	if needsNewline {
+		b, err := r.r.Peek(1)
+		if err != nil && err != io.EOF {
+			r.err = err
+			return false
+		}
+		if len(b) == 1 && b[0] == '\n' {
+			if r.hash != nil {
+				_, _ = r.hash.Write(b)
+			}
+			_, _ = r.r.Discard(1)
+			recSize++
+		}
+	}
+	r.NextRecordPos += int64(recSize)
+	return true
+}
+
+// maxPreallocSize is the biggest buffer we allocate up front for data
+// of a record. Bigger buffers grow as the data is read, so that a bogus
+// size in the header fails with io.EOF instead of allocating a huge buffer
+const maxPreallocSize = 1024 * 1024
+
+// readN reads exactly n bytes from r, into buf if it's big enough.
+// Returns io.EOF if there are less than n bytes
+func readN(r io.Reader, buf []byte, n int64) ([]byte, error) {
+	if n <= int64(cap(buf)) || n <= maxPreallocSize {
+		if n > int64(cap(buf)) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		_, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return buf, err
+	}
+	var b bytes.Buffer
+	b.Grow(maxPreallocSize)
+	_, err := io.CopyN(&b, r, n)
+	return b.Bytes(), err
+}
+
+// parseHeader parses the header of a record (including '\n' at the end),
+// setting Name, Timestamp and Tags. Returns size of data
+func (r *Reader) parseHeader(hdr []byte) (int64, error) {
 	rest := hdr[:len(hdr)-1] // remove '\n' from end
+	if r.Strict && hasEmptyField(rest) {
+		return 0, fmt.Errorf("empty field in header '%s'", string(hdr))
+	}
 	idx := bytes.IndexByte(rest, ' ')
 	var dataSize []byte
 	if idx == -1 {
-		if !r.NoTimestamp {
-			// with timestamp, we need at least 2 values separated by space
-			r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-			return false
-		}
+		// just size, no timestamp and no name
 		dataSize = rest
 		rest = nil
 	} else {
 		dataSize = rest[:idx]
 		rest = rest[idx+1:]
 	}
+	// be lenient about extra spaces before timestamp. We can't trim
+	// them in general because name can start with a space
+	if trimmed := bytes.TrimLeft(rest, " "); len(trimmed) < len(rest) {
+		idx = bytes.IndexByte(trimmed, ' ')
+		if idx == -1 {
+			idx = len(trimmed)
+		}
+		if !r.NoTimestamp && isNumber(trimmed[:idx]) {
+			rest = trimmed
+		}
+	}
 	var name []byte
 	var timestamp []byte
 	idx = bytes.IndexByte(rest, ' ')
 	if idx == -1 {
-		if r.NoTimestamp {
-			// no timestamp, just name
-			name = rest
-		} else {
-			// no name, just timestamp
+		// either timestamp or name. We disambiguate by checking if it's
+		// a number, unless we were told there's no timestamp
+		if !r.NoTimestamp && isNumber(rest) {
 			timestamp = rest
+		} else {
+			name = rest
 		}
 	} else {
-		// timestamp and name
-		timestamp = rest[:idx]
-		name = rest[idx+1:]
+		if isNumber(rest[:idx]) {
+			// timestamp and name
+			timestamp = rest[:idx]
+			name = rest[idx+1:]
+		} else {
+			// no timestamp, name with spaces
+			name = rest
+		}
 	}
 
 	size, err := strconv.ParseInt(string(dataSize), 10, 64)
 	if err != nil {
-		r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-		return false
+		return 0, fmt.Errorf("unexpected header '%s'", string(hdr))
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("negative size %d in header '%s'", size, string(hdr))
+	}
+	if r.MaxRecordSize > 0 && size > r.MaxRecordSize {
+		return 0, fmt.Errorf("size %d in header '%s' exceeds MaxRecordSize %d", size, string(hdr), r.MaxRecordSize)
 	}
 
 	if len(timestamp) > 0 {
 		timeMs, err := strconv.ParseInt(string(timestamp), 10, 64)
 		if err != nil {
-			r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-			return false
+			return 0, fmt.Errorf("unexpected header '%s'", string(hdr))
+		}
+		if timeMs < minUnixMs || timeMs > maxUnixMs {
+			return 0, fmt.Errorf("timestamp %d out of range in header '%s'", timeMs, string(hdr))
 		}
 		r.Timestamp = TimeFromUnixMillisecond(timeMs)
 	}
-	r.Name = string(name)
+	r.dataLen = int(size)
 
-	// we try to re-use r.Data as long as it doesn't grow too much
-	// (limit to 1 MB)
-	if cap(r.Data) > 1024*1024 {
-		r.Data = nil
+	name, r.Tags, err = parseHeaderTags(name, r.Tags[:0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid tag in header '%s': %s", string(hdr), err)
 	}
-	if size > int64(cap(r.Data)) {
-		r.Data = make([]byte, size)
-	} else {
-		// re-use existing buffer
-		r.Data = r.Data[:size]
+	r.Version = 0
+	if v, ok := getEntry(r.Tags, versionTag); ok {
+		r.Version, err = strconv.Atoi(v)
+		if err != nil || r.Version < 0 {
+			if r.Strict {
+				return 0, fmt.Errorf("invalid version in header '%s'", string(hdr))
+			}
+			r.Version = 0
+		}
+	}
+	if r.Strict && bytes.IndexByte(name, '=') != -1 {
+		// Writer only writes '=' in tags
+		return 0, fmt.Errorf("unknown field in header '%s'", string(hdr))
 	}
-	n, err := io.ReadFull(r.r, r.Data)
+	r.NameBytes, err = appendUnescaped(r.NameBytes[:0], name)
 	if err != nil {
-		r.err = err
-		return false
+		if r.Strict {
+			return 0, fmt.Errorf("invalid name in header '%s': %s", string(hdr), err)
+		}
+		// names written before we escaped them could have '%'
+		r.NameBytes = append(r.NameBytes[:0], name...)
 	}
-	panicIf(n != len(r.Data))
-	recSize += n
+	// comparing doesn't allocate, so we only allocate Name if it changed
+	if string(r.NameBytes) != r.Name {
+		r.Name = string(r.NameBytes)
+	}
+	return size, nil
 
-	// account for the fact that for readability we might
-	// have padded data with '\n'
-	// same as needsNewline logic in Writer.Write
-	n = len(r.Data)
-	needsNewline := (n > 0) && (r.Data[n-1] != '\n')
-	if needsNewline {
-		_, err = r.r.Discard(1)
+}
+
+// ParseHeader parses a header line of a record, with or without the
+// '\n' at the end. It does the same validation as Reader and returns
+// size of data, timestamp (zero if not present) and name. Tags, if any,
+// are not returned
+func ParseHeader(line []byte) (size int64, ts time.Time, name string, err error) {
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line[:len(line):len(line)], '\n')
+	}
+	var r Reader
+	size, err = r.parseHeader(line)
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+	return size, r.Timestamp, r.Name, nil
+}
+
+// SkipN skips n records, reading only their headers.
+// Returns number of skipped records, which is less than n
+// if there are no more records, and Err()
+func (r *Reader) SkipN(n int64) (int64, error) {
+	var skipped int64
+	for skipped < n && r.readNext(true) {
+		skipped++
+	}
+	return skipped, r.Err()
+}
+
+// Offsets calls fn with the position (CurrRecordPos) and name of
+// each remaining record, until fn returns false. Only headers
+// are parsed, data is skipped. Check Err() for errors
+func (r *Reader) Offsets(fn func(pos int64, name string) bool) {
+	for r.readNext(true) {
+		if !fn(r.CurrRecordPos, r.Name) {
+			return
+		}
+	}
+}
+
+// ResetPos sets the position of the next record to base. Positions
+// of records (CurrRecordPos, NextRecordPos) are relative to the start
+// of reading, so after switching the underlying reader to a different
+// file (e.g. after log rotation) use ResetPos(0) to make them relative
+// to the start of the new file
+func (r *Reader) ResetPos(base int64) {
+	r.CurrRecordPos = base
+	r.NextRecordPos = base
+}
+
+// AutoDetect reads a line written by Writer.WriteMagic, if the data
+// starts with it, and configures the reader accordingly. Must be called
+// before reading records. Data without the line is left as is
+func (r *Reader) AutoDetect() error {
+	d, err := r.r.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if string(d) != magic {
+		return nil
+	}
+	line, err := r.r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.NextRecordPos += int64(len(line))
+	if r.hash != nil {
+		_, _ = r.hash.Write(line)
+	}
+	s := string(line[:len(line)-1])
+	parts := strings.Split(s[len(magic):], " ")
+	if parts[0] != "v1" {
+		return fmt.Errorf("unsupported version in '%s'", s)
+	}
+	for _, feature := range parts[1:] {
+		switch feature {
+		case "notimestamp":
+			r.NoTimestamp = true
+		default:
+			return fmt.Errorf("unknown feature '%s' in '%s'", feature, s)
+		}
+	}
+	return nil
+}
+
+// Buffered returns the number of bytes read from the underlying reader
+// but not yet consumed. NextRecordPos is the number of bytes consumed
+// (relative to the start or ResetPos), so the position in the underlying
+// reader is NextRecordPos + Buffered(). When reading a siser section
+// followed by other data, the first Buffered() bytes of that data are
+// in the bufio.Reader passed to NewReader
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// DataLen returns size of data of the last record, as declared
+// in its header
+func (r *Reader) DataLen() int {
+	return r.dataLen
+}
+
+// Tag returns a value of a header tag of the last record read
+// with ReadNextData
+func (r *Reader) Tag(key string) (string, bool) {
+	return getEntry(r.Tags, key)
+}
+
+// hasEmptyField returns true if fields in header are not separated
+// by exactly one space
+func hasEmptyField(hdr []byte) bool {
+	n := len(hdr)
+	if n == 0 || hdr[0] == ' ' || hdr[n-1] == ' ' {
+		return true
+	}
+	return bytes.Contains(hdr, []byte("  "))
+}
+
+// parseHeaderTags splits trailing "key=value" tags from the name part
+// of the header. Tags are appended to tags.
+func parseHeaderTags(name []byte, tags []Entry) ([]byte, []Entry, error) {
+	// find where tags start: all trailing words with '=' in them,
+	// ignoring trailing spaces
+	start := len(name)
+	for {
+		end := start
+		for end > 0 && name[end-1] == ' ' {
+			end--
+		}
+		if end == 0 {
+			break
+		}
+		idx := bytes.LastIndexByte(name[:end], ' ')
+		if bytes.IndexByte(name[idx+1:end], '=') == -1 {
+			break
+		}
+		if idx == -1 {
+			start = 0
+			break
+		}
+		start = idx
+	}
+	if start == len(name) {
+		return name, tags, nil
+	}
+	rest := name[start:]
+	name = name[:start]
+	for _, word := range bytes.Fields(rest) {
+		idx := bytes.IndexByte(word, '=')
+		key, err := unescapeTag(word[:idx])
 		if err != nil {
-			r.err = err
-			return false
+			return nil, nil, err
+		}
+		val, err := unescapeTag(word[idx+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		e := Entry{
+			Key:   key,
+			Value: val,
 		}
-		recSize++
+		tags = append(tags, e)
 	}
-	r.NextRecordPos += int64(recSize)
-	return true
+	return name, tags, nil
 }
 
 // ReadNextRecord reads a key / value record.
@@ -171,21 +604,218 @@ func (r *Reader) ReadNextData() bool {
 // Check Err() for errors.
 // After reading information is in Record (valid until
 // next read).
+// Records written with Writer.Delta are re-created from the previous
+// record, which must have been read with ReadNextRecord
 func (r *Reader) ReadNextRecord() bool {
+	hadPrev := r.hasPrev
 	ok := r.ReadNextData()
 	if !ok {
 		return false
 	}
+	return r.decodeRecord(hadPrev)
+}
+
+// ReadNextNamed is like ReadNextRecord but reads the next record with
+// a given name in the header. Data of other records is skipped without
+// decoding it, so it can't read records written with Writer.Delta
+// (unless all records have the same name)
+func (r *Reader) ReadNextNamed(name string) bool {
+	for {
+		hadPrev := r.hasPrev
+		if !r.readHeader() {
+			return false
+		}
+		if r.Name == name {
+			return r.readData(false) && r.decodeRecord(hadPrev)
+		}
+		if !r.readData(true) {
+			return false
+		}
+	}
+}
 
-	_, r.err = UnmarshalRecord(r.Data, r.Record)
-	if r.err != nil {
+// decodeRecord decodes Data into Record. hadPrev is true if the
+// previous record was decoded, so that we can apply a delta to it
+func (r *Reader) decodeRecord(hadPrev bool) bool {
+	_, _, err := unmarshalRecord(r.Data, r.Record, r.MaxRecordEntries, r.Strict)
+	if err != nil {
+		r.err = err
 		return false
 	}
+	if idx := indexOfKey(r.Tags, deltaTag); idx != -1 {
+		r.Tags = append(r.Tags[:idx], r.Tags[idx+1:]...)
+		if !hadPrev {
+			r.err = fmt.Errorf("no previous record for a delta at position %d", r.CurrRecordPos)
+			return false
+		}
+		entries, err := applyDelta(r.prevEntries, r.Record.Entries)
+		if err != nil {
+			r.err = fmt.Errorf("%s in record at position %d", err, r.CurrRecordPos)
+			return false
+		}
+		// the delta can be small even if the record is not
+		if r.MaxRecordEntries > 0 && len(entries) > r.MaxRecordEntries {
+			r.err = fmt.Errorf("more than %d entries in record at position %d", r.MaxRecordEntries, r.CurrRecordPos)
+			return false
+		}
+		r.Record.Entries = entries
+		// marshaled data is the delta
+		r.Record.buf = r.Record.buf[:0]
+	}
+	r.prevEntries = append(r.prevEntries[:0], r.Record.Entries...)
+	r.hasPrev = true
+	entries := r.Record.Entries
+	if r.NameKey != "" && len(entries) > 0 && entries[0].Key == r.NameKey {
+		if r.Name == "" {
+			r.Name = entries[0].Value
+			r.NameBytes = append(r.NameBytes[:0], r.Name...)
+		}
+		r.Record.Entries = append(entries[:0], entries[1:]...)
+		r.Record.buf = r.Record.buf[:0]
+	}
 	r.Record.Name = r.Name
 	r.Record.Timestamp = r.Timestamp
+	r.Record.Tags = append(r.Record.Tags, r.Tags...)
+	// version is a property of the stream, not the record
+	if idx := indexOfKey(r.Record.Tags, versionTag); idx != -1 {
+		r.Record.Tags = append(r.Record.Tags[:idx], r.Record.Tags[idx+1:]...)
+	}
 	return true
 }
 
+// Records reads all records in a background goroutine and sends them
+// to the returned channel, which is closed when there are no more records
+// or when done is closed. Records are clones, so they can be retained.
+// Reading is blocked when there are bufSize records not received from
+// the channel, so a caller that stops receiving before the records
+// channel is closed must close done, or the goroutine leaks.
+// After the records channel is closed, the error channel receives
+// Err() (nil if there were no errors) and is closed.
+// Reader must not be used by the caller until the channels are closed
+func (r *Reader) Records(bufSize int, done <-chan struct{}) (<-chan *Record, <-chan error) {
+	recs := make(chan *Record, bufSize)
+	errc := make(chan error, 1)
+	go func() {
+	loop:
+		for r.ReadNextRecord() {
+			select {
+			case recs <- r.Record.Clone():
+			case <-done:
+				break loop
+			}
+		}
+		close(recs)
+		errc <- r.Err()
+		close(errc)
+	}()
+	return recs, errc
+}
+
+// ReadBatch reads up to n records into dst (at most len(dst)) and
+// returns the number of records read. Records are copies (see
+// Record.CopyTo), re-using non-nil records in dst, so dst can be
+// re-used between batches. Returns 0 and nil if there are no more records
+func (r *Reader) ReadBatch(n int, dst []*Record) (int, error) {
+	if n > len(dst) {
+		n = len(dst)
+	}
+	i := 0
+	for i < n && r.ReadNextRecord() {
+		if dst[i] == nil {
+			dst[i] = &Record{}
+		}
+		r.Record.CopyTo(dst[i])
+		i++
+	}
+	return i, r.Err()
+}
+
+// ReadRecordAt reads a record that starts at offset in r and decodes it
+// into rec. Returns number of bytes used by the record, including the header.
+// Returns io.EOF if there are no records at offset.
+// Offsets are CurrRecordPos / NextRecordPos of Reader. Since io.ReaderAt
+// is safe for concurrent use, it can be called from multiple goroutines
+// with different rec.
+func ReadRecordAt(r io.ReaderAt, offset int64, rec *Record) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	sr := io.NewSectionReader(r, offset, math.MaxInt64-offset)
+	reader := NewReader(bufio.NewReader(sr))
+	reader.Record = rec
+	if !reader.ReadNextRecord() {
+		if err := reader.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	return int(reader.NextRecordPos), nil
+}
+
+// ReadOneRecord reads exactly one record, as written by Writer.WriteRecord,
+// from r and decodes it into rec. Unlike Reader, it doesn't read ahead,
+// so r can be used for something else after that e.g. when using records
+// as messages over a network connection. To not read past the record,
+// the header is read one byte at a time and the padding after data is
+// assumed, so it can't read records written with Writer.NoPadding.
+// If maxSize > 0, records with bigger data are rejected with an error
+// (see Reader.MaxRecordSize), which should be used when reading from
+// untrusted peers.
+// Returns number of bytes read and io.EOF if there are no more records
+func ReadOneRecord(r io.Reader, rec *Record, maxSize int64) (int, error) {
+	var hdr []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			hdr = append(hdr, b[0])
+			if b[0] == '\n' {
+				break
+			}
+			continue
+		}
+		if err == io.EOF && len(hdr) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return len(hdr), err
+		}
+	}
+	reader := Reader{
+		MaxRecordSize: maxSize,
+	}
+	size, err := reader.parseHeader(hdr)
+	if err != nil {
+		return len(hdr), err
+	}
+	data, err := readN(r, nil, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return len(hdr) + len(data), err
+	}
+	d := append(hdr, data...)
+	if size > 0 && d[len(d)-1] != '\n' {
+		_, err = io.ReadFull(r, b[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return len(d), err
+		}
+		if b[0] != '\n' {
+			return len(d) + 1, fmt.Errorf("missing newline after data")
+		}
+		d = append(d, '\n')
+	}
+	_, err = ReadRecordAt(bytes.NewReader(d), 0, rec)
+	if err != nil {
+		return len(d), err
+	}
+	return len(d), nil
+}
+
 // Err returns error from last Read. We swallow io.EOF to make it easier
 // to use
 func (r *Reader) Err() error {
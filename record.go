@@ -2,9 +2,15 @@ package siser
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,6 +23,13 @@ The basic format is line-oriented: "key: value\n"
 When value is long (> 120 chars) or has \n in it, we serialize it as:
 key:+$len\n
 value\n
+
+Records with only short values can also be serialized in a single line
+(see Writer.Inline):
+key=value\tkey2=value2\n
+with '%', '=', ':', tab and control characters percent-escaped. Since every
+line in the basic format has ':', a single line without ':' is
+in the inline format.
 */
 
 type Entry struct {
@@ -24,15 +37,44 @@ type Entry struct {
 	Value string
 }
 
+// Valuer is implemented by types that can be written as a value
+// with Record.WriteValue
+type Valuer interface {
+	SiserValue() string
+}
+
 // Record represents list of key/value pairs that can
 // be serialized/deserialized
 type Record struct {
 	// Entries are available after Unmarshal/UnmarshalRecord
 	Entries []Entry
-	buf     strings.Builder
-	Name    string
+	// marshaled Entries, re-used between records after Reset
+	buf  []byte
+	Name string
 	// when writing, if not provided we use current time
 	Timestamp time.Time
+	// Tags are optional key/value pairs written in the header
+	// (see Writer.WriteTagged)
+	Tags []Entry
+}
+
+var recordPool = sync.Pool{
+	New: func() interface{} {
+		return &Record{}
+	},
+}
+
+// GetRecord returns an empty record from a pool of records.
+// Use PutRecord to return it to the pool when no longer needed
+func GetRecord() *Record {
+	return recordPool.Get().(*Record)
+}
+
+// PutRecord resets r and returns it to the pool of records used
+// by GetRecord. r must not be used after calling PutRecord
+func PutRecord(r *Record) {
+	r.Reset()
+	recordPool.Put(r)
 }
 
 func (r *Record) appendKeyVal(key, val string) {
@@ -51,6 +93,8 @@ func (r *Record) Write(args ...string) {
 	if n == 0 || n%2 != 0 {
 		panic(fmt.Sprintf("Invalid number of args: %d", len(args)))
 	}
+	// we append to marshaled data, which must include existing entries
+	r.marshalEntries()
 	for i := 0; i < n; i += 2 {
 		r.marshalKeyVal(args[i], args[i+1])
 		// TODO: this is for api compat with older version
@@ -59,6 +103,155 @@ func (r *Record) Write(args ...string) {
 	}
 }
 
+// WriteEntries writes entries to a record e.g. entries of
+// another record
+func (r *Record) WriteEntries(entries ...Entry) {
+	for _, e := range entries {
+		r.Write(e.Key, e.Value)
+	}
+}
+
+// WriteKV is like Write but returns an error instead of panicking
+// if number of args is odd. It's meant for args built at runtime
+func (r *Record) WriteKV(args ...string) error {
+	n := len(args)
+	if n%2 != 0 {
+		return fmt.Errorf("odd number of args: %d", n)
+	}
+	if n > 0 {
+		r.Write(args...)
+	}
+	return nil
+}
+
+// WriteChecked is like WriteKV but also returns an error if a key
+// is not valid (see checkKey). Nothing is written if there's an error
+func (r *Record) WriteChecked(args ...string) error {
+	n := len(args)
+	if n%2 != 0 {
+		return fmt.Errorf("odd number of args: %d", n)
+	}
+	for i := 0; i < n; i += 2 {
+		if err := checkKey(args[i]); err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		r.Write(args...)
+	}
+	return nil
+}
+
+// checkKey returns an error if key can't be decoded or would make
+// the record hard to read. Keys must be non-empty, printable ASCII
+// without ':'.
+// Write allows empty key, which is written as ": value" and decoded
+// as an empty key, but it's most likely a bug
+func checkKey(key string) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		if b < 32 || b >= 127 {
+			return fmt.Errorf("invalid character 0x%02x in key '%s'", b, key)
+		}
+		if b == ':' {
+			return fmt.Errorf("invalid character ':' in key '%s'", key)
+		}
+	}
+	return nil
+}
+
+// WriteIf writes key/value if cond is true
+func (r *Record) WriteIf(cond bool, key, value string) {
+	if cond {
+		r.Write(key, value)
+	}
+}
+
+// WriteNonEmpty writes key/value if value is not empty
+func (r *Record) WriteNonEmpty(key, value string) {
+	r.WriteIf(value != "", key, value)
+}
+
+// With writes key/value and returns r, for chaining:
+// (&Record{}).With("a", "1").With("b", "2")
+func (r *Record) With(key, value string) *Record {
+	r.Write(key, value)
+	return r
+}
+
+// Validate returns an error for the first entry that would not be
+// decoded as written i.e. with ':' or newline in the key.
+// Values, Name and Tags are always decoded as written, in both
+// basic and inline format. Unlike WriteChecked, empty and non-ASCII
+// keys are allowed
+func (r *Record) Validate() error {
+	for i, e := range r.Entries {
+		if strings.ContainsAny(e.Key, ":\n") {
+			return fmt.Errorf("invalid key '%s' of entry %d", e.Key, i)
+		}
+	}
+	return nil
+}
+
+// Writef writes a value formatted with fmt.Sprintf for a given key
+func (r *Record) Writef(key string, format string, args ...interface{}) {
+	r.Write(key, fmt.Sprintf(format, args...))
+}
+
+// WriteValue writes v.SiserValue() as value for a given key.
+// Use GetValue to decode it
+func (r *Record) WriteValue(key string, v Valuer) {
+	r.Write(key, v.SiserValue())
+}
+
+// WriteError writes err.Error() as value for a given key.
+// If err is nil, writes "<nil>"
+func (r *Record) WriteError(key string, err error) {
+	val := "<nil>"
+	if err != nil {
+		val = err.Error()
+	}
+	r.Write(key, val)
+}
+
+// WriteTime writes t formatted as time.RFC3339Nano as value
+// for a given key
+func (r *Record) WriteTime(key string, t time.Time) {
+	r.WriteTimeLayout(key, t, time.RFC3339Nano)
+}
+
+// WriteTimeLayout writes t formatted with layout as value
+// for a given key
+func (r *Record) WriteTimeLayout(key string, t time.Time, layout string) {
+	r.Write(key, t.Format(layout))
+}
+
+// WriteDuration writes d as value for a given key, formatted
+// with d.String() (e.g. "1.41ms") which GetDuration parses back exactly
+func (r *Record) WriteDuration(key string, d time.Duration) {
+	r.Write(key, d.String())
+}
+
+// InsertAt inserts key/value entry at a given position in Entries.
+// index must be between 0 and len(Entries)
+func (r *Record) InsertAt(index int, key, value string) error {
+	if index < 0 || index > len(r.Entries) {
+		return fmt.Errorf("index %d out of range [0, %d]", index, len(r.Entries))
+	}
+	r.Entries = append(r.Entries, Entry{})
+	copy(r.Entries[index+1:], r.Entries[index:])
+	r.Entries[index] = Entry{
+		Key:   key,
+		Value: value,
+	}
+	// Marshal will re-create it from entries
+	r.buf = r.buf[:0]
+	return nil
+}
+
 // Reset makes it easy to re-use Record (as opposed to allocating a new one
 // each time)
 func (r *Record) Reset() {
@@ -66,14 +259,226 @@ func (r *Record) Reset() {
 		r.Entries = r.Entries[0:0]
 	}
 	r.Name = ""
+	r.Tags = r.Tags[:0]
 	var t time.Time
 	r.Timestamp = t
-	r.buf.Reset()
+	// don't hold on to large buffers
+	if cap(r.buf) > 1024*1024 {
+		r.buf = nil
+	}
+	r.buf = r.buf[:0]
 }
 
 // Get returns a value for a given key
 func (r *Record) Get(key string) (string, bool) {
+	return getEntry(r.Entries, key)
+}
+
+// GetFold is like Get but matches keys case-insensitively
+// (see strings.EqualFold), e.g. "Content-Type" matches "content-type"
+func (r *Record) GetFold(key string) (string, bool) {
 	for _, e := range r.Entries {
+		if strings.EqualFold(e.Key, key) {
+			return e.Value, true
+		}
+	}
+	return "", false
+}
+
+// GetOr returns a value for a given key or def if there's no value
+func (r *Record) GetOr(key, def string) string {
+	if v, ok := r.Get(key); ok {
+		return v
+	}
+	return def
+}
+
+// GetIntOr returns a value for a given key parsed as int or def
+// if there's no value or it's not a valid int
+func (r *Record) GetIntOr(key string, def int) int {
+	v, ok := r.Get(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// GetFloatOr returns a value for a given key parsed as float64 or def
+// if there's no value or it's not a valid float
+func (r *Record) GetFloatOr(key string, def float64) float64 {
+	v, ok := r.Get(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// GetTime returns a time value, written with WriteTime, for a given key.
+// Returns false if there's no value for key and an error if the value
+// is not a valid time
+func (r *Record) GetTime(key string) (time.Time, bool, error) {
+	return r.GetTimeLayout(key, time.RFC3339Nano)
+}
+
+// GetTimeLayout is like GetTime for a value written with WriteTimeLayout
+func (r *Record) GetTimeLayout(key string, layout string) (time.Time, bool, error) {
+	v, ok := r.Get(key)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(layout, v)
+	return t, true, err
+}
+
+// GetDuration returns a value for a given key written with WriteDuration.
+// Returns false if there's no value for key
+func (r *Record) GetDuration(key string) (time.Duration, bool, error) {
+	v, ok := r.Get(key)
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(v)
+	return d, true, err
+}
+
+// GetValue calls parse with the value for a given key, to decode a value
+// written with WriteValue. Returns false if there's no value for key
+// and the error returned by parse
+func (r *Record) GetValue(key string, parse func(string) error) (bool, error) {
+	v, ok := r.Get(key)
+	if !ok {
+		return false, nil
+	}
+	return true, parse(v)
+}
+
+// Scan decodes values for keys into dests, which must be pointers
+// to string, int, int64, float64, bool, time.Time (written with
+// WriteTime) or time.Duration (written with WriteDuration).
+// It's an error if a key is missing or a value can't be decoded
+func (r *Record) Scan(keys []string, dests ...interface{}) error {
+	if len(keys) != len(dests) {
+		return fmt.Errorf("%d keys but %d destinations", len(keys), len(dests))
+	}
+	for i, key := range keys {
+		v, ok := r.Get(key)
+		if !ok {
+			return fmt.Errorf("no value for key '%s'", key)
+		}
+		var err error
+		switch d := dests[i].(type) {
+		case *string:
+			*d = v
+		case *int:
+			*d, err = strconv.Atoi(v)
+		case *int64:
+			*d, err = strconv.ParseInt(v, 10, 64)
+		case *float64:
+			*d, err = strconv.ParseFloat(v, 64)
+		case *bool:
+			*d, err = strconv.ParseBool(v)
+		case *time.Time:
+			*d, err = time.Parse(time.RFC3339Nano, v)
+		case *time.Duration:
+			*d, err = time.ParseDuration(v)
+		default:
+			return fmt.Errorf("unsupported destination type %T for key '%s'", dests[i], key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for key '%s': %s", key, err)
+		}
+	}
+	return nil
+}
+
+// RangeValues calls fn with every value for a given key, in order,
+// until fn returns false
+func (r *Record) RangeValues(key string, fn func(value string) bool) {
+	for _, e := range r.Entries {
+		if e.Key == key && !fn(e.Value) {
+			return
+		}
+	}
+}
+
+// Has returns true if record has an entry for a given key
+func (r *Record) Has(key string) bool {
+	return indexOfKey(r.Entries, key) != -1
+}
+
+// HasDuplicateKeys returns true if more than one entry has the same key
+func (r *Record) HasDuplicateKeys() bool {
+	for i, e := range r.Entries {
+		if indexOfKey(r.Entries[:i], e.Key) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateKeys returns keys that appear in more than one entry
+func (r *Record) DuplicateKeys() []string {
+	var res []string
+	for i, e := range r.Entries {
+		if indexOfKey(r.Entries[:i], e.Key) == -1 {
+			continue
+		}
+		if !containsString(res, e.Key) {
+			res = append(res, e.Key)
+		}
+	}
+	return res
+}
+
+// Compact removes entries with duplicate keys. The last value of
+// a key is kept at the position of its first entry
+func (r *Record) Compact() {
+	n := 0
+	for _, e := range r.Entries {
+		if idx := indexOfKey(r.Entries[:n], e.Key); idx != -1 {
+			r.Entries[idx].Value = e.Value
+			continue
+		}
+		r.Entries[n] = e
+		n++
+	}
+	r.Entries = r.Entries[:n]
+	r.buf = r.buf[:0]
+}
+
+func indexOfKey(entries []Entry, key string) int {
+	for i, e := range entries {
+		if e.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsString(a []string, s string) bool {
+	for _, s2 := range a {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag returns a value of a header tag for a given key
+func (r *Record) Tag(key string) (string, bool) {
+	return getEntry(r.Tags, key)
+}
+
+func getEntry(entries []Entry, key string) (string, bool) {
+	for _, e := range entries {
 		if e.Key == key {
 			return e.Value, true
 		}
@@ -81,6 +486,237 @@ func (r *Record) Get(key string) (string, bool) {
 	return "", false
 }
 
+// Clone returns a deep copy of the record
+func (r *Record) Clone() *Record {
+	res := &Record{
+		Name:      r.Name,
+		Timestamp: r.Timestamp,
+	}
+	if len(r.Entries) > 0 {
+		res.Entries = append([]Entry(nil), r.Entries...)
+	}
+	if len(r.Tags) > 0 {
+		res.Tags = append([]Entry(nil), r.Tags...)
+	}
+	return res
+}
+
+// CopyTo is like Clone but copies the record into dst, re-using
+// its memory. Useful with records from GetRecord
+func (r *Record) CopyTo(dst *Record) {
+	if dst == r {
+		return
+	}
+	dst.Reset()
+	dst.Entries = append(dst.Entries, r.Entries...)
+	dst.Tags = append(dst.Tags, r.Tags...)
+	dst.Name = r.Name
+	dst.Timestamp = r.Timestamp
+}
+
+// Filter returns a new record with only the entries for which keep
+// returns true. Name, Timestamp and Tags are copied
+func (r *Record) Filter(keep func(key, value string) bool) *Record {
+	res := &Record{
+		Name:      r.Name,
+		Timestamp: r.Timestamp,
+		Tags:      append([]Entry(nil), r.Tags...),
+	}
+	for _, e := range r.Entries {
+		if keep(e.Key, e.Value) {
+			res.Write(e.Key, e.Value)
+		}
+	}
+	return res
+}
+
+// FilterKeys returns a new record with only the entries with given keys.
+// Name, Timestamp and Tags are copied
+func (r *Record) FilterKeys(keys ...string) *Record {
+	return r.Filter(func(key, value string) bool {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Rename changes key of the first entry with oldKey to newKey,
+// keeping the order of entries. Returns false if there's no such entry
+func (r *Record) Rename(oldKey, newKey string) bool {
+	for i, e := range r.Entries {
+		if e.Key == oldKey {
+			r.Entries[i].Key = newKey
+			r.buf = r.buf[:0]
+			return true
+		}
+	}
+	return false
+}
+
+// RenameAll is like Rename but changes all entries with oldKey.
+// Returns number of renamed entries
+func (r *Record) RenameAll(oldKey, newKey string) int {
+	n := 0
+	for i, e := range r.Entries {
+		if e.Key == oldKey {
+			r.Entries[i].Key = newKey
+			n++
+		}
+	}
+	if n > 0 {
+		r.buf = r.buf[:0]
+	}
+	return n
+}
+
+// Trim removes leading and trailing white space from values
+func (r *Record) Trim() {
+	for i, e := range r.Entries {
+		r.Entries[i].Value = strings.TrimSpace(e.Value)
+	}
+	r.buf = r.buf[:0]
+}
+
+// TrimKeys removes leading and trailing white space from keys
+func (r *Record) TrimKeys() {
+	for i, e := range r.Entries {
+		r.Entries[i].Key = strings.TrimSpace(e.Key)
+	}
+	r.buf = r.buf[:0]
+}
+
+// SortEntries sorts entries by key, preserving the order of
+// entries with the same key
+func (r *Record) SortEntries() {
+	sort.SliceStable(r.Entries, func(i, j int) bool {
+		return r.Entries[i].Key < r.Entries[j].Key
+	})
+	// Marshal will re-create it from sorted entries
+	r.buf = r.buf[:0]
+}
+
+// SortFunc sorts entries using less, preserving the order of
+// entries that are equal
+func (r *Record) SortFunc(less func(a, b Entry) bool) {
+	sort.SliceStable(r.Entries, func(i, j int) bool {
+		return less(r.Entries[i], r.Entries[j])
+	})
+	r.buf = r.buf[:0]
+}
+
+// Hash returns a hash of entries, computed over entries sorted by key
+// (see SortEntries), so records with the same entries inserted in
+// a different order have the same hash. Name, Timestamp and Tags are
+// not included (see HashWithMeta)
+func (r *Record) Hash() uint64 {
+	h := fnv.New64a()
+	writeSortedEntries(h, r.Entries)
+	return h.Sum64()
+}
+
+// HashWithMeta is like Hash but also includes Name, Timestamp (with
+// millisecond precision, as written by Writer) and Tags (sorted by key)
+func (r *Record) HashWithMeta() uint64 {
+	h := fnv.New64a()
+	writeSortedEntries(h, r.Entries)
+	fmt.Fprintf(h, "%d %s\n", len(r.Name), r.Name)
+	fmt.Fprintf(h, "%d\n", TimeToUnixMillisecond(r.Timestamp))
+	writeSortedEntries(h, r.Tags)
+	return h.Sum64()
+}
+
+// writeSortedEntries writes entries, sorted by key, to w in
+// an unambiguous format
+func writeSortedEntries(w io.Writer, entries []Entry) {
+	rec := &Record{
+		Entries: append([]Entry(nil), entries...),
+	}
+	rec.SortEntries()
+	d := rec.Marshal()
+	fmt.Fprintf(w, "%d\n", len(d))
+	_, _ = w.Write(d)
+}
+
+// ToJSONObject returns a JSON object with values (as strings) for given
+// keys, in that order. Keys that are not in the record are skipped.
+// If no keys are given, it includes all keys in the order of Entries.
+// For duplicate keys the first value is used, like Get
+func (r *Record) ToJSONObject(keys ...string) ([]byte, error) {
+	if len(keys) == 0 {
+		for _, e := range r.Entries {
+			keys = append(keys, e.Key)
+		}
+	}
+	buf := []byte{'{'}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		v, ok := r.Get(key)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if len(seen) > 1 {
+			buf = append(buf, ',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, k...)
+		buf = append(buf, ':')
+		d, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, d...)
+	}
+	buf = append(buf, '}')
+	return buf, nil
+}
+
+// String returns a human-readable, single-line representation of
+// the record for logging and debugging. Use Marshal for serialization
+func (r *Record) String() string {
+	var sb strings.Builder
+	if r.Name != "" {
+		sb.WriteString(readableValue(r.Name))
+		sb.WriteByte(' ')
+	}
+	if !r.Timestamp.IsZero() {
+		sb.WriteString(r.Timestamp.Format(time.RFC3339Nano))
+		sb.WriteByte(' ')
+	}
+	for _, e := range r.Tags {
+		sb.WriteString(readableValue(e.Key))
+		sb.WriteByte('=')
+		sb.WriteString(readableValue(e.Value))
+		sb.WriteByte(' ')
+	}
+	sb.WriteByte('{')
+	for i, e := range r.Entries {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(readableValue(e.Key))
+		sb.WriteString(": ")
+		sb.WriteString(readableValue(e.Value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// readableValue quotes s if it's empty or has characters that
+// would make the output of String() ambiguous
+func readableValue(s string) string {
+	if s == "" || !serializableOnLine(s) || strings.ContainsAny(s, ",{}\"") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
 func nonEmptyEndsWithNewline(s string) bool {
 	n := len(s)
 	return n == 0 || s[n-1] == '\n'
@@ -93,56 +729,354 @@ func needsLongFormat(s string) bool {
 }
 
 func (r *Record) marshalKeyVal(key, val string) {
-	r.buf.WriteString(key)
+	r.buf = append(r.buf, key...)
 	isLong := needsLongFormat(val)
 	if isLong {
-		r.buf.WriteString(":+")
-		slen := strconv.Itoa(len(val))
-		r.buf.WriteString(slen)
-		r.buf.WriteByte('\n')
-		r.buf.WriteString(val)
+		r.buf = append(r.buf, ":+"...)
+		r.buf = strconv.AppendInt(r.buf, int64(len(val)), 10)
+		r.buf = append(r.buf, '\n')
+		r.buf = append(r.buf, val...)
 		// for readability: ensure a newline at the end so
 		// that header record always appears on new line
 		if !nonEmptyEndsWithNewline(val) {
-			r.buf.WriteByte('\n')
+			r.buf = append(r.buf, '\n')
 		}
 	} else {
-		r.buf.WriteString(": ")
-		r.buf.WriteString(val)
-		r.buf.WriteByte('\n')
+		r.buf = append(r.buf, ": "...)
+		r.buf = append(r.buf, val...)
+		r.buf = append(r.buf, '\n')
 	}
 }
 
 // Marshal converts record to bytes
 func (r *Record) Marshal() []byte {
-	return []byte(r.buf.String())
+	r.marshalEntries()
+	return append([]byte(nil), r.buf...)
+}
+
+// marshalEntries re-creates marshaled data from Entries if
+// the record was filled by Unmarshal or Entries were changed
+func (r *Record) marshalEntries() {
+	if len(r.buf) > 0 || len(r.Entries) == 0 {
+		return
+	}
+	// fast path for the common case of only short values
+	n := 0
+	for _, e := range r.Entries {
+		if needsLongFormat(e.Value) {
+			n = -1
+			break
+		}
+		// ": " and "\n"
+		n += len(e.Key) + len(e.Value) + 3
+	}
+	if n == -1 {
+		r.growBuf(r.MarshalSize())
+		for _, e := range r.Entries {
+			r.marshalKeyVal(e.Key, e.Value)
+		}
+		return
+	}
+	r.growBuf(n)
+	for _, e := range r.Entries {
+		r.buf = append(r.buf, e.Key...)
+		r.buf = append(r.buf, ": "...)
+		r.buf = append(r.buf, e.Value...)
+		r.buf = append(r.buf, '\n')
+	}
+}
+
+// growBuf makes sure buf has space for n more bytes
+func (r *Record) growBuf(n int) {
+	if len(r.buf)+n > cap(r.buf) {
+		buf := make([]byte, len(r.buf), len(r.buf)+n)
+		copy(buf, r.buf)
+		r.buf = buf
+	}
+}
+
+// MarshalSize returns size of data returned by Marshal, without
+// allocating. Useful for pre-allocating buffers
+func (r *Record) MarshalSize() int {
+	n := 0
+	for _, e := range r.Entries {
+		n += len(e.Key) + len(e.Value)
+		if needsLongFormat(e.Value) {
+			// ":+${len}\n"
+			n += 3 + intStrLen(len(e.Value))
+			if !nonEmptyEndsWithNewline(e.Value) {
+				n++
+			}
+		} else {
+			// ": " and "\n"
+			n += 3
+		}
+	}
+	return n
+}
+
+// canMarshalInline returns true if record can be serialized
+// in the inline format
+func (r *Record) canMarshalInline() bool {
+	if len(r.Entries) == 0 {
+		return false
+	}
+	for _, e := range r.Entries {
+		if needsLongFormat(e.Value) || len(e.Key) > 120 {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalInline serializes record in the single line format
+func (r *Record) marshalInline() []byte {
+	var res []byte
+	for i, e := range r.Entries {
+		if i > 0 {
+			res = append(res, '\t')
+		}
+		res = append(res, escapeInline(e.Key)...)
+		res = append(res, '=')
+		res = append(res, escapeInline(e.Value)...)
+	}
+	return append(res, '\n')
+}
+
+// isInline returns true if d is a record in the single line format
+func isInline(d []byte) bool {
+	idx := bytes.IndexByte(d, '\n')
+	return idx != -1 && idx == len(d)-1 && bytes.IndexByte(d, ':') == -1
+}
+
+func unmarshalInline(d []byte, r *Record, maxEntries int) error {
+	d = d[:len(d)-1]
+	offset := 0
+	for _, field := range bytes.Split(d, []byte{'\t'}) {
+		if maxEntries > 0 && len(r.Entries) >= maxEntries {
+			return newParseError(offset, "more than %d entries in record", maxEntries)
+		}
+		idx := bytes.IndexByte(field, '=')
+		if idx == -1 {
+			return newParseError(offset, "field in unrecognized format: '%s'", field)
+		}
+		key, err := unescapeTag(field[:idx])
+		if err != nil {
+			return &ParseError{Offset: offset, Err: err}
+		}
+		val, err := unescapeTag(field[idx+1:])
+		if err != nil {
+			return &ParseError{Offset: offset + idx + 1, Err: err}
+		}
+		r.appendKeyVal(key, val)
+		offset += len(field) + 1
+	}
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+// It's the same as Marshal i.e. doesn't include Name and Timestamp
+func (r *Record) MarshalText() ([]byte, error) {
+	return r.Marshal(), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// It's the same as Unmarshal
+func (r *Record) UnmarshalText(d []byte) error {
+	return r.Unmarshal(d)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Unlike Marshal, the result includes Name and Timestamp (if set)
+// and is in the same format as written by Writer.WriteRecord
+func (r *Record) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// don't make up a timestamp if it wasn't set
+	w.NoTimestamp = r.Timestamp.IsZero()
+	_, err := w.WriteRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// It decodes data created by MarshalBinary
+func (r *Record) UnmarshalBinary(d []byte) error {
+	n, err := unmarshalFramed(d, r, false)
+	if err != nil {
+		return err
+	}
+	if n != len(d) {
+		return fmt.Errorf("%d trailing bytes after record", len(d)-n)
+	}
+	return nil
+}
+
+// RoundTrip encodes r with MarshalBinary and decodes the result into
+// a new record, in strict mode. It's meant for tests: a record that
+// round-trips is equal to the result, except the timestamp which is
+// truncated to milliseconds
+func RoundTrip(r *Record) (*Record, error) {
+	d, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res := &Record{}
+	n, err := unmarshalFramed(d, res, true)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(d) {
+		return nil, fmt.Errorf("%d trailing bytes after record", len(d)-n)
+	}
+	return res, nil
+}
+
+// UnmarshalFramed decodes a record, as written by Writer.WriteRecord, from
+// the beginning of d. Returns the record and number of bytes of d it
+// takes, so the next record starts at d[n:]
+func UnmarshalFramed(d []byte) (*Record, int, error) {
+	rec := &Record{}
+	n, err := unmarshalFramed(d, rec, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, n, nil
+}
+
+// unmarshalFramed decodes a record at the beginning of d into r, in Strict
+// mode if strict is set (see Reader.Strict). Returns size of the record in d
+func unmarshalFramed(d []byte, r *Record, strict bool) (int, error) {
+	idx := bytes.IndexByte(d, '\n')
+	if idx == -1 {
+		return 0, errors.New("no record in data")
+	}
+	var reader Reader
+	reader.Record = r
+	reader.Strict = strict
+	// data can't be bigger than d, so we reject bogus sizes
+	// before slicing
+	reader.MaxRecordSize = int64(len(d))
+	size, err := reader.parseHeader(d[:idx+1])
+	if err != nil {
+		return 0, err
+	}
+	start := idx + 1
+	end := start + int(size)
+	if end > len(d) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	reader.Data = d[start:end]
+	// same as needsNewline logic in Reader.readData
+	if size > 0 && d[end-1] != '\n' && end < len(d) && d[end] == '\n' {
+		end++
+	}
+	if !reader.decodeRecord(false) {
+		return 0, reader.err
+	}
+	return end, nil
+}
+
+// ParseError is returned when decoding data that is not a valid record
+type ParseError struct {
+	// Offset is the position in data where invalid data starts
+	Offset int
+	Err    error
+}
+
+func newParseError(offset int, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Offset: offset,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Err, e.Offset)
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
 }
 
 // UnmarshalRecord unmarshall record as marshalled with Record.Marshal
 // For efficiency re-uses record r. If r is nil, will allocate new record.
 func UnmarshalRecord(d []byte, r *Record) (*Record, error) {
+	rec, _, err := unmarshalRecord(d, r, 0, false)
+	return rec, err
+}
+
+// UnmarshalEntries decodes data created by Marshal into entries,
+// over-writing its content, and returns the decoded entries.
+// It only allocates a new slice if the record has more than
+// cap(entries) entries
+func UnmarshalEntries(d []byte, entries []Entry) ([]Entry, error) {
+	r := Record{
+		Entries: entries[:0],
+	}
+	_, _, err := unmarshalRecord(d, &r, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.Entries, nil
+}
+
+// UnmarshalRecordStrict is like UnmarshalRecord but only accepts data exactly
+// as written by Marshal.
+// Marshal adds a newline after a long value for readability, unless the
+// value ends with a newline. UnmarshalRecord skips a newline after a long
+// value if it's there. UnmarshalRecordStrict requires the newline
+// only where Marshal would add it, so an extra empty line or a missing
+// newline is an error.
+func UnmarshalRecordStrict(d []byte, r *Record) (*Record, error) {
+	rec, _, err := unmarshalRecord(d, r, 0, true)
+	return rec, err
+}
+
+// unmarshalRecord is like UnmarshalRecord but also returns number
+// of bytes of d that were consumed. If maxEntries > 0, it's an error
+// to decode more than maxEntries entries. See UnmarshalRecordStrict
+// for the meaning of strict
+func unmarshalRecord(d []byte, r *Record, maxEntries int, strict bool) (*Record, int, error) {
+	size := len(d)
 	if r == nil {
 		r = &Record{}
 	} else {
 		r.Reset()
 	}
 
+	if isInline(d) {
+		err := unmarshalInline(d, r, maxEntries)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, size, nil
+	}
+
 	for len(d) > 0 {
+		// offset of the current line in data
+		offset := size - len(d)
+		if maxEntries > 0 && len(r.Entries) >= maxEntries {
+			return nil, 0, newParseError(offset, "more than %d entries in record", maxEntries)
+		}
 		idx := bytes.IndexByte(d, '\n')
 		if idx == -1 {
-			return nil, fmt.Errorf("missing '\n' marking end of header in '%s'", string(d))
+			return nil, 0, newParseError(offset, "missing '\n' marking end of header in '%s'", string(d))
 		}
 		line := d[:idx]
 		d = d[idx+1:]
 		idx = bytes.IndexByte(line, ':')
 		if idx == -1 {
-			return nil, fmt.Errorf("line in unrecognized format: '%s'", line)
+			return nil, 0, newParseError(offset, "line in unrecognized format: '%s'", line)
 		}
 		key := line[:idx]
 		val := line[idx+1:]
 		// at this point val must be at least one character (' ' or '+')
 		if len(val) < 1 {
-			return nil, fmt.Errorf("line in unrecognized format: '%s'", line)
+			return nil, 0, newParseError(offset, "line in unrecognized format: '%s'", line)
 		}
 		kind := val[0]
 		val = val[1:]
@@ -152,28 +1086,36 @@ func UnmarshalRecord(d []byte, r *Record) (*Record, error) {
 		}
 
 		if kind != '+' {
-			return nil, fmt.Errorf("line in unrecognized format: '%s'", line)
+			return nil, 0, newParseError(offset, "line in unrecognized format: '%s'", line)
 		}
 
 		n, err := strconv.Atoi(string(val))
 		if err != nil {
-			return nil, err
+			return nil, 0, &ParseError{Offset: offset, Err: err}
 		}
 		if n < 0 {
-			return nil, fmt.Errorf("negative length %d of data", n)
+			return nil, 0, newParseError(offset, "negative length %d of data", n)
 		}
 		if n > len(d) {
-			return nil, fmt.Errorf("length of value %d greater than remaining data of size %d", n, len(d))
+			return nil, 0, newParseError(offset, "length of value %d greater than remaining data of size %d", n, len(d))
 		}
 		val = d[:n]
 		d = d[n:]
-		// encoder might put optional newline
-		if len(d) > 0 && d[0] == '\n' {
+		if strict {
+			// Marshal adds newline only if value doesn't end with it
+			if !nonEmptyEndsWithNewline(string(val)) {
+				if len(d) == 0 || d[0] != '\n' {
+					return nil, 0, newParseError(size-len(d), "missing '\\n' after value of key '%s'", key)
+				}
+				d = d[1:]
+			}
+		} else if len(d) > 0 && d[0] == '\n' {
+			// encoder might put optional newline
 			d = d[1:]
 		}
 		r.appendKeyVal(string(key), string(val))
 	}
-	return r, nil
+	return r, size - len(d), nil
 }
 
 // Unmarshal resets record and decodes data as created by Marshal
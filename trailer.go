@@ -0,0 +1,83 @@
+package siser
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
+)
+
+// trailerTag is a header tag marking a trailer written by
+// Writer.WriteTrailer
+const trailerTag = "siser.trailer"
+
+// WriteTrailer writes a trailer record with crc32 checksum and size
+// of all data written by w, which VerifyTrailer checks. It should be
+// the last record and written by the same Writer as all the data, so
+// it can't be used when appending to existing files.
+// Writer.Checksum must be set before the first write and it can't
+// be used with Writer.JSONL.
+// The trailer is a regular record (see Reader.IsTrailer)
+func (w *Writer) WriteTrailer() (int, error) {
+	if !w.Checksum || w.noCrc {
+		return 0, fmt.Errorf("checksum is only calculated if Writer.Checksum is set before the first write")
+	}
+	if w.JSONL {
+		return 0, fmt.Errorf("trailer can't be written in JSONL format")
+	}
+	var rec Record
+	rec.Write("crc32", strconv.FormatUint(uint64(w.crc), 16))
+	rec.Write("size", strconv.FormatInt(w.size, 10))
+	tags := []Entry{{trailerTag, "1"}}
+	return w.write(rec.Marshal(), "", time.Time{}, "", tags)
+}
+
+// IsTrailer returns true if the last record read is a trailer
+// written by Writer.WriteTrailer
+func (r *Reader) IsTrailer() bool {
+	_, ok := r.Tag(trailerTag)
+	return ok
+}
+
+// VerifyTrailer reads all records from r and checks that the last one is
+// a trailer written by Writer.WriteTrailer, with checksum and size that
+// match the data before it
+func VerifyTrailer(r io.Reader) error {
+	reader := NewReader(bufio.NewReader(r))
+	h := crc32.NewIEEE()
+	reader.hash = h
+	if err := reader.AutoDetect(); err != nil {
+		return err
+	}
+	var rec Record
+	for {
+		crc := h.Sum32()
+		if !reader.ReadNextData() {
+			if err := reader.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("no trailer")
+		}
+		if !reader.IsTrailer() {
+			continue
+		}
+		pos := reader.CurrRecordPos
+		if err := rec.Unmarshal(reader.Data); err != nil {
+			return fmt.Errorf("invalid trailer at position %d: %s", pos, err)
+		}
+		expCrc, _ := rec.Get("crc32")
+		expSize, _ := rec.Get("size")
+		if expCrc != strconv.FormatUint(uint64(crc), 16) {
+			return fmt.Errorf("checksum %x doesn't match %s in trailer at position %d", crc, expCrc, pos)
+		}
+		if expSize != strconv.FormatInt(pos, 10) {
+			return fmt.Errorf("size %d doesn't match %s in trailer at position %d", pos, expSize, pos)
+		}
+		if reader.ReadNextData() || reader.Err() != nil {
+			return fmt.Errorf("data after trailer at position %d", pos)
+		}
+		return nil
+	}
+}
@@ -1,10 +1,21 @@
 package siser
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"net/url"
+	"strings"
 	"time"
 )
 
+const (
+	// range of Unix epoch time in milliseconds that can be converted
+	// to nanoseconds without overflowing int64
+	minUnixMs = math.MinInt64 / 1000000
+	maxUnixMs = math.MaxInt64 / 1000000
+)
+
 func fmtArgs(args ...interface{}) string {
 	if len(args) == 0 {
 		return ""
@@ -40,14 +51,17 @@ func panicIf(cond bool, args ...interface{}) {
 
 // intStrLen calculates how long n would be when converted to a string
 // i.e. equivalent of len(strconv.Itoa(n)) but faster
-// Note: not used
 func intStrLen(n int) int {
+	return intStrLen64(int64(n))
+}
+
+// intStrLen64 is like intStrLen for int64
+func intStrLen64(n int64) int {
 	l := 1 // count the last digit here
 	if n < 0 {
-		n = -n
 		l = 2
 	}
-	for n > 9 {
+	for n > 9 || n < -9 {
 		l++
 		n = n / 10
 	}
@@ -65,6 +79,157 @@ func serializableOnLine(s string) bool {
 	return true
 }
 
+// needsTagEscape returns true if b must be percent-escaped in a header tag
+func needsTagEscape(b byte) bool {
+	return b <= ' ' || b >= 127 || b == '=' || b == '%'
+}
+
+// needsNameEscape returns true if b must be percent-escaped in a name
+// in the header. We allow spaces and utf8 in names
+func needsNameEscape(b byte) bool {
+	return b < ' ' || b == 127 || b == '=' || b == '%'
+}
+
+// needsInlineEscape returns true if b must be percent-escaped in
+// a record serialized in the inline format
+func needsInlineEscape(b byte) bool {
+	return b < ' ' || b == 127 || b == '=' || b == '%' || b == ':'
+}
+
+// escapeName percent-escapes s so that it can be written as a name
+// in the header. Spaces at the start and end and doubled spaces are
+// also escaped, because they would look like empty fields in the header
+func escapeName(s string) string {
+	s = percentEscape(s, needsNameEscape)
+	n := len(s)
+	if n == 0 || (s[0] != ' ' && s[n-1] != ' ' && !strings.Contains(s, "  ")) {
+		return s
+	}
+	buf := make([]byte, 0, n+8)
+	for i := 0; i < n; i++ {
+		b := s[i]
+		if b == ' ' && (i == 0 || i == n-1 || s[i-1] == ' ') {
+			buf = append(buf, "%20"...)
+		} else {
+			buf = append(buf, b)
+		}
+	}
+	return string(buf)
+}
+
+// escapeNumberName percent-escapes the first byte of an escaped name
+// if its first word is a number. Without a timestamp in the header,
+// the reader would read the number as a timestamp
+func escapeNumberName(name string) string {
+	word := name
+	if idx := strings.IndexByte(name, ' '); idx != -1 {
+		word = name[:idx]
+	}
+	if !isNumber([]byte(word)) {
+		return name
+	}
+	const hex = "0123456789ABCDEF"
+	b := name[0]
+	return "%" + string(hex[b>>4]) + string(hex[b&15]) + name[1:]
+}
+
+// escapeInline percent-escapes s so that it can be written
+// in the inline format
+func escapeInline(s string) string {
+	return percentEscape(s, needsInlineEscape)
+}
+
+func percentEscape(s string, needsEscape func(byte) bool) string {
+	n := percentEscapedLen(s, needsEscape)
+	if n == len(s) {
+		return s
+	}
+	buf := make([]byte, 0, n)
+	return string(appendPercentEscaped(buf, s, needsEscape))
+}
+
+// percentEscapedLen returns length of s after percent-escaping
+func percentEscapedLen(s string, needsEscape func(byte) bool) int {
+	n := len(s)
+	for i := 0; i < len(s); i++ {
+		if needsEscape(s[i]) {
+			n += 2
+		}
+	}
+	return n
+}
+
+// appendPercentEscaped appends percent-escaped s to dst
+func appendPercentEscaped(dst []byte, s string, needsEscape func(byte) bool) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if needsEscape(b) {
+			dst = append(dst, '%', hex[b>>4], hex[b&15])
+		} else {
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// unescapeTag reverses escaping of tags (see needsTagEscape), escapeName
+// and escapeInline
+func unescapeTag(d []byte) (string, error) {
+	if bytes.IndexByte(d, '%') == -1 {
+		return string(d), nil
+	}
+	return url.PathUnescape(string(d))
+}
+
+// appendUnescaped appends percent-unescaped d to dst.
+// It's like unescapeTag, without allocating a string
+func appendUnescaped(dst []byte, d []byte) ([]byte, error) {
+	for i := 0; i < len(d); i++ {
+		b := d[i]
+		if b != '%' {
+			dst = append(dst, b)
+			continue
+		}
+		if i+2 >= len(d) || !isHex(d[i+1]) || !isHex(d[i+2]) {
+			return dst, fmt.Errorf("invalid escape in '%s'", string(d))
+		}
+		dst = append(dst, unhex(d[i+1])<<4|unhex(d[i+2]))
+		i += 2
+	}
+	return dst, nil
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= 'a':
+		return b - 'a' + 10
+	case b >= 'A':
+		return b - 'A' + 10
+	}
+	return b - '0'
+}
+
+// isNumber returns true if d looks like a (possibly negative) decimal integer
+func isNumber(d []byte) bool {
+	if len(d) > 0 && d[0] == '-' {
+		d = d[1:]
+	}
+	if len(d) == 0 {
+		return false
+	}
+	for _, b := range d {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 // TimeToUnixMillisecond converts t into Unix epoch time in milliseconds.
 // That's because seconds is not enough precision and nanoseconds is too much.
 func TimeToUnixMillisecond(t time.Time) int64 {
@@ -1,17 +1,88 @@
 package siser
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"strconv"
 	"time"
 )
 
-// Writer writes records to in a structured format
+// Writer writes records to in a structured format.
+// It's not safe for concurrent use
 type Writer struct {
 	w io.Writer
+	// re-used between writes to avoid allocations
+	buf []byte
 	// NoTimestamp disables writing timestamp, which
 	// makes serialized data not depend on when they were written
+	// and makes the header smaller. Reader detects headers
+	// without timestamp
 	NoTimestamp bool
+	// NoPadding disables writing a newline after data that doesn't end
+	// with newline. The padding makes the data more readable, so without
+	// it files are less pleasant to read but slightly smaller.
+	// Reader detects data without padding
+	NoPadding bool
+	// AutoFlush flushes the underlying writer after each write, if it
+	// has Flush() method (like bufio.Writer). This makes each record
+	// visible immediately (e.g. for tail -f) but defeats the purpose of
+	// buffering, so writing many records is much slower
+	AutoFlush bool
+	// Inline makes WriteRecord write records with only short values
+	// in a more compact, single line format e.g.:
+	// "key=value\tkey2=value2\n" instead of "key: value\nkey2: value2\n".
+	// Reader and UnmarshalRecord detect it
+	Inline bool
+	// Delta makes WriteRecord write only changes from the previous
+	// record written with WriteRecord (see Diff), which is much smaller
+	// when consecutive records share most values.
+	// Reader.ReadNextRecord re-creates full records, but only when reading
+	// all records in order. Reading a delta record without the record
+	// before it fails with "no previous record for a delta", so delta
+	// streams can't be used with ReadRecordAt, Index, ReverseReader,
+	// ReadNextRecord after SkipN or ReadNextNamed and MergeReaders
+	Delta bool
+	// NameKey, if set, makes WriteRecord also write the name of the record
+	// as the first entry with this key, for readers that expect the type
+	// of the record in the data (see Reader.NameKey)
+	NameKey string
+	// Version, if > 0, is written in the header of each record as
+	// a tag, so that readers can decode records written with different
+	// versions of a schema (see Reader.Version)
+	Version int
+	// JSONL makes WriteRecord write records as single-line JSON objects
+	// (JSON Lines format) instead of siser format, for exporting to tools
+	// that only read JSON. See Writer.writeJSON for the format.
+	// Reader can't read it. Write and WriteString are not affected
+	JSONL bool
+	// SyncOnClose makes Close call Sync() on the underlying writer, if
+	// it has it (like *os.File), so that the data is on disk when Close
+	// returns. It's slow but needed for durability
+	SyncOnClose bool
+	// Checksum makes the Writer calculate crc32 checksum of all written
+	// data, which WriteTrailer writes. It must be set before the first
+	// write
+	Checksum bool
+
+	// entries of the last record, if it was written with WriteRecord
+	prevEntries []Entry
+	hasPrev     bool
+
+	// crc32 and size of all written data, for WriteTrailer
+	crc  uint32
+	size int64
+	// true if data was written without Checksum set, so crc is not valid
+	noCrc bool
+}
+
+type flusher interface {
+	Flush() error
+}
+
+type syncer interface {
+	Sync() error
 }
 
 // NewWriter creates a writer
@@ -21,45 +92,353 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
-// WriteRecord writes a record in a specified format
+// versionTag is a header tag with Writer.Version
+const versionTag = "siser.version"
+
+// magic starts the optional first line describing the stream,
+// followed by version, space-separated features and '\n'
+const magic = "#siser "
+
+// WriteMagic writes a line describing the format of the stream
+// (e.g. "#siser v1 notimestamp\n"), which Reader.AutoDetect reads to
+// configure itself. It's optional and must be written before any records
+func (w *Writer) WriteMagic() (int, error) {
+	s := magic + "v1"
+	if w.NoTimestamp {
+		s += " notimestamp"
+	}
+	s += "\n"
+	n, err := io.WriteString(w.w, s)
+	w.updateChecksum([]byte(s[:n]))
+	return n, err
+}
+
+// WriteRecord writes a record in a specified format.
+// Timestamp in the header is r.Timestamp or, if it's zero,
+// current time (unless NoTimestamp is set)
 func (w *Writer) WriteRecord(r *Record) (int, error) {
-	d := r.Marshal()
-	return w.Write(d, r.Timestamp, r.Name)
+	return w.WriteRecordTime(r, r.Timestamp)
+}
+
+// WriteRecordTime is like WriteRecord but writes t as timestamp
+// in the header, regardless of r.Timestamp. If t is zero, we use
+// current time
+func (w *Writer) WriteRecordTime(r *Record, t time.Time) (int, error) {
+	if w.JSONL {
+		return w.writeJSON(r, t)
+	}
+	full := r
+	if w.NameKey != "" && r.Name != "" {
+		full = &Record{
+			Entries: append([]Entry{{w.NameKey, r.Name}}, r.Entries...),
+		}
+	}
+	toWrite := full
+	tags := r.Tags
+	if w.Delta && w.hasPrev {
+		prev := &Record{Entries: w.prevEntries}
+		if delta, ok := Diff(prev, full); ok {
+			toWrite = delta
+			tags = append(tags[:len(tags):len(tags)], Entry{deltaTag, "1"})
+		}
+	}
+	var d []byte
+	if w.Inline && toWrite.canMarshalInline() {
+		d = toWrite.marshalInline()
+	} else {
+		d = toWrite.Marshal()
+	}
+	n, err := w.write(d, "", t, r.Name, tags)
+	if err == nil && w.Delta {
+		w.prevEntries = append(w.prevEntries[:0], full.Entries...)
+		w.hasPrev = true
+	}
+	return n, err
+}
+
+// WriteRecordBytes is like WriteRecord but also returns the bytes
+// it wrote, including the header. The returned slice is a fresh
+// allocation owned by the caller. On error the slice is nil, because
+// the record might not have been encoded or was written partially
+// (n tells how many bytes were written)
+func (w *Writer) WriteRecordBytes(r *Record) ([]byte, int, error) {
+	n, err := w.WriteRecord(r)
+	if err != nil {
+		return nil, n, err
+	}
+	d := append([]byte(nil), w.buf...)
+	return d, n, nil
 }
 
 // Write writes a block of data with optional timestamp and name.
 // Returns number of bytes written (length of d + lenght of metadata)
 // and an error
 func (w *Writer) Write(d []byte, t time.Time, name string) (int, error) {
-	var hdr string
+	return w.WriteTagged(d, t, name, nil)
+}
+
+// WriteTagged is like Write but also writes tags in the header.
+// Tags can be read with Reader.Tag without decoding the data
+func (w *Writer) WriteTagged(d []byte, t time.Time, name string, tags []Entry) (int, error) {
+	return w.write(d, "", t, name, tags)
+}
+
+// WriteString is like Write for string data, with current time
+// and no name
+func (w *Writer) WriteString(s string) (int, error) {
+	return w.write(nil, s, time.Time{}, "", nil)
+}
+
+// WriteStringNamed is like Write for string data, with current time
+func (w *Writer) WriteStringNamed(s string, name string) (int, error) {
+	return w.write(nil, s, time.Time{}, name, nil)
+}
+
+// write writes either d or s (the other must be empty) so that
+// we don't have to convert string to []byte
+func (w *Writer) write(d []byte, s string, t time.Time, name string, tags []Entry) (int, error) {
+	// Reader can only apply a delta to the previous record
+	w.hasPrev = false
+	n := len(d) + len(s)
+	// newline in name would break the header
+	name = escapeName(name)
 	if w.NoTimestamp {
-		hdr = strconv.Itoa(len(d))
-	} else {
+		name = escapeNumberName(name)
+	}
+	var ms int64
+	if !w.NoTimestamp {
 		if t.IsZero() {
 			t = time.Now()
 		}
-		ms := TimeToUnixMillisecond(t)
-		hdr = strconv.Itoa(len(d)) + " " + strconv.FormatInt(ms, 10)
+		ms = TimeToUnixMillisecond(t)
 	}
-	if name != "" {
-		hdr += " " + name
+	if w.Version > 0 && indexOfKey(tags, versionTag) == -1 {
+		tags = append(tags[:len(tags):len(tags)], Entry{versionTag, strconv.Itoa(w.Version)})
+	}
+	// tags are escaped directly into buf, this is their size
+	tagsLen := 0
+	for _, e := range tags {
+		tagsLen += 2 + percentEscapedLen(e.Key, needsTagEscape) + percentEscapedLen(e.Value, needsTagEscape)
 	}
-	hdr += "\n"
-	n := len(d)
-	bufSize := len(hdr) + n
 	// for readability, if the record doesn't end with newline,
 	// we add one at the end. Makes decoding a bit harder but
 	// not by much.
-	needsNewline := (n > 0) && (d[n-1] != '\n')
+	var lastByte byte
+	if len(d) > 0 {
+		lastByte = d[n-1]
+	} else if len(s) > 0 {
+		lastByte = s[n-1]
+	}
+	needsNewline := (n > 0) && (lastByte != '\n') && !w.NoPadding
+
+	// calculate exact size so that we only allocate if
+	// re-used buffer is too small
+	bufSize := intStrLen(n) + 1 + n
+	if !w.NoTimestamp {
+		bufSize += 1 + intStrLen64(ms)
+	}
+	if name != "" {
+		bufSize += 1 + len(name)
+	}
+	bufSize += tagsLen
 	if needsNewline {
-		bufSize += 1
+		bufSize++
+	}
+	// don't hold on to large buffers
+	if cap(w.buf) > 1024*1024 {
+		w.buf = nil
+	}
+	if bufSize > cap(w.buf) {
+		w.buf = make([]byte, 0, bufSize)
 	}
 
-	buf := make([]byte, 0, bufSize)
-	buf = append(buf, hdr...)
+	buf := w.buf[:0]
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	if !w.NoTimestamp {
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, ms, 10)
+	}
+	if name != "" {
+		buf = append(buf, ' ')
+		buf = append(buf, name...)
+	}
+	for _, e := range tags {
+		buf = append(buf, ' ')
+		buf = appendPercentEscaped(buf, e.Key, needsTagEscape)
+		buf = append(buf, '=')
+		buf = appendPercentEscaped(buf, e.Value, needsTagEscape)
+	}
+	buf = append(buf, '\n')
 	buf = append(buf, d...)
+	buf = append(buf, s...)
 	if needsNewline {
 		buf = append(buf, '\n')
 	}
-	return w.w.Write(buf)
+	panicIf(len(buf) != bufSize, "len(buf) = %d, bufSize = %d", len(buf), bufSize)
+	// remember the last frame for WriteRecordBytes
+	w.buf = buf
+	return w.writeRaw(buf)
+}
+
+// updateChecksum updates crc and size with written data d
+func (w *Writer) updateChecksum(d []byte) {
+	if w.Checksum {
+		w.crc = crc32.Update(w.crc, crc32.IEEETable, d)
+	} else if len(d) > 0 {
+		w.noCrc = true
+	}
+	w.size += int64(len(d))
+}
+
+// writeRaw writes d to the underlying writer
+func (w *Writer) writeRaw(d []byte) (int, error) {
+	nWritten, err := w.w.Write(d)
+	w.updateChecksum(d[:nWritten])
+	if err == nil && w.AutoFlush {
+		if f, ok := w.w.(flusher); ok {
+			err = f.Flush()
+		}
+	}
+	return nWritten, err
+}
+
+// keys of fields with metadata of a record in JSON written by writeJSON
+const (
+	jsonNameKey      = "_name"
+	jsonTimestampKey = "_timestamp"
+	jsonTagsKey      = "_tags"
+)
+
+// writeJSON writes r as a JSON object in a single line e.g.:
+// {"_name":"httplog","_timestamp":1553488435903,"_tags":{"level":"info"},"url":"/","code":"200"}
+// "_name" is only written if the record has a name, "_timestamp"
+// (in Unix epoch milliseconds) unless NoTimestamp is set and "_tags"
+// if the record has tags. Entries are written in order as string values,
+// including repeated keys, which JSON allows. It's an error if a key
+// of an entry is one of the keys for metadata
+func (w *Writer) writeJSON(r *Record, t time.Time) (int, error) {
+	w.hasPrev = false
+	for _, e := range r.Entries {
+		if e.Key == jsonNameKey || e.Key == jsonTimestampKey || e.Key == jsonTagsKey {
+			return 0, fmt.Errorf("key '%s' is reserved in JSONL format", e.Key)
+		}
+	}
+	buf := append(w.buf[:0], '{')
+	if r.Name != "" {
+		buf = appendJSONField(buf, jsonNameKey, r.Name)
+	}
+	if !w.NoTimestamp {
+		if t.IsZero() {
+			t = time.Now()
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, jsonTimestampKey)
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, TimeToUnixMillisecond(t), 10)
+	}
+	if len(r.Tags) > 0 {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, jsonTagsKey)
+		buf = append(buf, ':', '{')
+		for i, e := range r.Tags {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONField(buf, e.Key, e.Value)
+		}
+		buf = append(buf, '}')
+	}
+	for _, e := range r.Entries {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONField(buf, e.Key, e.Value)
+	}
+	buf = append(buf, '}', '\n')
+	w.buf = buf
+	return w.writeRaw(buf)
+}
+
+// appendJSONField appends "key":"value" to buf
+func appendJSONField(buf []byte, key, value string) []byte {
+	buf = appendJSONString(buf, key)
+	buf = append(buf, ':')
+	return appendJSONString(buf, value)
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	// encoding a string can't fail
+	d, _ := json.Marshal(s)
+	return append(buf, d...)
+}
+
+// Close flushes the underlying writer, if it has Flush() method,
+// syncs it if SyncOnClose is set and closes it, if it's an io.Closer.
+// Close doesn't sync by default. Returns the first error
+func (w *Writer) Close() error {
+	var err error
+	if f, ok := w.w.(flusher); ok {
+		err = f.Flush()
+	}
+	if s, ok := w.w.(syncer); ok && w.SyncOnClose {
+		if err2 := s.Sync(); err == nil {
+			err = err2
+		}
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// TeeWriter writes to a primary writer and mirrors it to other writers.
+// Unlike io.MultiWriter, the number of bytes written is the count
+// from the primary writer, so it can be used with Writer to tee records
+// e.g. to a file and a network connection
+type TeeWriter struct {
+	primary io.Writer
+	mirrors []io.Writer
+	// BestEffort makes us write to all mirrors even if writing to
+	// one of them fails. The first error is returned. By default
+	// we stop at the first error
+	BestEffort bool
+}
+
+// NewTeeWriter creates a TeeWriter
+func NewTeeWriter(primary io.Writer, mirrors ...io.Writer) *TeeWriter {
+	return &TeeWriter{
+		primary: primary,
+		mirrors: mirrors,
+	}
+}
+
+// Write writes p to the primary writer and then to mirrors
+func (t *TeeWriter) Write(p []byte) (int, error) {
+	n, err := t.primary.Write(p)
+	if err != nil {
+		return n, err
+	}
+	var firstErr error
+	for _, w := range t.mirrors {
+		nMirror, err := w.Write(p)
+		if err == nil && nMirror != len(p) {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			continue
+		}
+		if !t.BestEffort {
+			return n, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return n, firstErr
 }